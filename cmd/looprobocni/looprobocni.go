@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"embed"
 	"encoding/json"
 	"flag"
@@ -10,11 +11,17 @@ import (
 	"math/rand"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"syscall"
 	"text/template"
 	"time"
+
+	"github.com/dougbtv/robocniconfig/pkg/config"
+	"github.com/dougbtv/robocniconfig/pkg/robocni"
 )
 
 type Stats struct {
@@ -30,12 +37,18 @@ var (
 func main() {
 
 	// Define flags
+	configPath := flag.String("config", "", "Path of the robocni config file (defaults to "+config.DefaultPath()+")")
+	profileName := flag.String("profile", "", "Profile of the config file to use")
 	promptFilePath := flag.String("promptfile", "prompts.txt", "Output just the CNI json instead of a net-attach-def")
 	ollamaHost := flag.String("host", "", "The IP address of the ollama host")
 	ollamaPort := flag.String("port", "11434", "The port address of the ollama service")
 	ollamaModel := flag.String("model", "llama2:13b", "The port address of the ollama service")
+	connectTimeout := flag.Duration("connect-timeout", robocni.DefaultConnectTimeout, "Give up connecting to the LLM service after this long, 0 for no limit")
+	queryTimeout := flag.Duration("timeout", robocni.DefaultTimeout, "Give up on a query to the LLM after this long, 0 for no limit")
 	numberOfRuns := flag.Int("runs", 1, "Number of runs to run")
+	seed := flag.Int64("seed", 0, "Seed for picking hints and generating, to replay a previous set of runs (random by default)")
 	introspectNetwork := flag.Bool("introspect", false, "Introspect networking on a k8s worker node")
+	recordFile := flag.String("recordfile", "", "Append a JSON record of each run, with the prompt and every response from the model, to this file")
 	useAnnotation := flag.Bool("useannotation", false, "Use the annotation instead of execing the pod")
 	help := flag.Bool("help", false, "Display help information")
 
@@ -49,15 +62,48 @@ func main() {
 		os.Exit(0)
 	}
 
-	if *ollamaHost == "" {
+	// Flags override OLLAMA_HOST, which overrides the config file profile.
+	setFlags := config.SetFlags(flag.CommandLine)
+	if !setFlags["host"] && os.Getenv("OLLAMA_HOST") != "" {
 		*ollamaHost = os.Getenv("OLLAMA_HOST")
-		if *ollamaHost == "" {
-			fmt.Println("Please set --host or the OLLAMA_HOST environment variable.")
-			os.Exit(1)
-		}
+		setFlags["host"] = true
+	}
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	profile, err := cfg.Profile(*profileName)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := config.Apply(flag.CommandLine, setFlags, profile.FlagValues()); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if *ollamaHost == "" && profile.Endpoint == "" {
+		fmt.Println("Please set --host, the OLLAMA_HOST environment variable or a host or endpoint in the config profile.")
+		os.Exit(1)
+	}
+
+	providerName, apiKey := profile.Provider, profile.APIKey
+	if providerName == "" {
+		providerName = "ollama"
+	}
+	if apiKey == "" {
+		apiKey = os.Getenv("OPENAI_API_KEY")
+	}
+	provider, err := robocni.NewProvider(providerName, profile.Endpoint, *ollamaHost, *ollamaPort, *ollamaModel, apiKey, robocni.NewHTTPClient(*connectTimeout, *queryTimeout))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
 
 	// Network introspection
+	host := &robocni.HostNetwork{}
+	var ifs, routes string
 	if *introspectNetwork {
 		// kubectl get nodes --no-headers | grep -m 1 -v control-plane | awk '{print $1}'
 		err := introspectNodeNetwork()
@@ -65,6 +111,33 @@ func main() {
 			fmt.Println("Error introspecting node network: ", err)
 			os.Exit(1)
 		}
+		host, ifs, routes, err = robocni.ReadHostFiles(ipLinkOutputFile, iprouteOutputfile)
+		if err != nil {
+			fmt.Println("Error reading node network: ", err)
+			os.Exit(1)
+		}
+	}
+
+	// Runs don't use the response cache, so each one is a fresh generation.
+	opts := robocni.Options{
+		Provider:         provider,
+		Model:            *ollamaModel,
+		Host:             host,
+		RawInterfaces:    ifs,
+		RawRoutes:        routes,
+		FixMaster:        true,
+		Templates:        robocni.Templates{Dir: profile.TemplateDir, SystemPrompt: profile.PromptTemplate},
+		ExampleSelection: profile.ExampleSelection,
+		EmbedModel:       profile.EmbedModel,
+		Namespace:        profile.Namespace,
+		Labels:           profile.Labels,
+		Annotations:      profile.Annotations,
+		Retries:          robocni.DefaultRetries,
+		Log:              func(message string) { fmt.Println(message) },
+	}
+	if _, err := robocni.NewGenerator(opts); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
 
 	var numerrors int
@@ -72,6 +145,7 @@ func main() {
 	var failedpodcreate int
 	var pingerrors int
 	var totalruns int
+	failurereasons := map[string]int{}
 	lastnetattachdef := ""
 	numhintlines, err := countLinesofHint(*promptFilePath)
 	if err != nil {
@@ -79,12 +153,23 @@ func main() {
 	}
 	statsArray := make([]Stats, numhintlines)
 
-	for i := 1; i <= *numberOfRuns; i++ {
+	// Run i generates with seed+i, so the seed is enough to replay every run.
+	if *seed == 0 {
+		*seed = time.Now().UnixNano() % 1000000
+	}
+	fmt.Printf("Seed: %d\n", *seed)
+	hintRand := rand.New(rand.NewSource(*seed))
+
+	// Ctrl-C stops the runs, and still reports on the ones done.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	for i := 1; i <= *numberOfRuns && ctx.Err() == nil; i++ {
 
 		totalruns++
 
 		if i > 1 {
-			generateReport(i-1, numerrors, numgenerationerrors, failedpodcreate, pingerrors, statsArray)
+			generateReport(i-1, numerrors, numgenerationerrors, failurereasons, failedpodcreate, pingerrors, statsArray)
 		}
 
 		// Delete the last netattachdef.
@@ -95,26 +180,42 @@ func main() {
 
 		fmt.Printf("------------------ RUN # %v\n", i)
 
-		netattachdefstr, usedlinenumber, err := runRobocni(*promptFilePath, *ollamaHost, *ollamaPort, *ollamaModel, *introspectNetwork)
+		runOpts := opts
+		runSeed := *seed + int64(i)
+		runOpts.Options = withSeed(profile.Options, runSeed)
+		hint, usedlinenumber, result, err := runRobocni(ctx, *promptFilePath, runOpts, hintRand)
+		if ctx.Err() != nil {
+			// An interrupted run doesn't count.
+			totalruns--
+			break
+		}
+		if *recordFile != "" {
+			if err := appendRecord(*recordFile, newRunRecord(i, runSeed, hint, result, err)); err != nil {
+				fmt.Printf("Error recording run #%d: %v\n", i, err)
+			}
+		}
 		if err != nil {
-			fmt.Printf("Error generating robocni net-attach-def, run #%d: %v\n", i, err)
+			reason := robocni.FailureReason(err)
+			fmt.Printf("Error generating robocni net-attach-def, run #%d (%s): %v\n", i, reason, err)
 			numerrors++
 			numgenerationerrors++
+			failurereasons[reason]++
 			continue
 		}
 
 		statsArray[usedlinenumber].Runs++
 
-		fmt.Printf("---\n%s\n", netattachdefstr)
-		// fmt.Printf("Run %d usedline: %v\n", i+1, usedlinenumber)
-
-		parsedname, err := parseName(netattachdefstr)
-		// Prefix the name so we can find all these.
+		if attempt := result.SucceededAttempt(); attempt != nil {
+			fmt.Printf("Generated on attempt %d of %d\n", attempt.Number, len(result.Attempts))
+		}
+		netattachdefstr, err := robocni.RenderNetAttachDef(result.NetAttachDef, false)
 		if err != nil {
-			fmt.Printf("Error parsing name: %s\n", err)
+			fmt.Printf("Error rendering net-attach-def: %s\n", err)
 			numerrors++
 			continue
 		}
+		fmt.Printf("---\n%s\n", netattachdefstr)
+		parsedname := result.Name
 		fmt.Println("Parsed name: " + parsedname)
 
 		// Delete for redundancy in case.
@@ -199,7 +300,7 @@ func main() {
 
 	}
 
-	generateReport(totalruns, numerrors, numgenerationerrors, failedpodcreate, pingerrors, statsArray)
+	generateReport(totalruns, numerrors, numgenerationerrors, failurereasons, failedpodcreate, pingerrors, statsArray)
 
 }
 
@@ -290,11 +391,19 @@ func launchDebuggerPod(nodeName string) (string, error) {
 	return matches[0], nil
 }
 
-func generateReport(runNumber, numErrors, numGenerationErrors, failedPodCreate, pingErrors int, statsArray []Stats) {
+func generateReport(runNumber, numErrors, numGenerationErrors int, failureReasons map[string]int, failedPodCreate, pingErrors int, statsArray []Stats) {
 	fmt.Printf("---\n")
 	fmt.Printf("Run number: %d\n", runNumber)
 	fmt.Printf("Total Errors: %d (%.2f%%)\n", numErrors, percent(numErrors, runNumber))
 	fmt.Printf("Generation Errors: %d (%.2f%%)\n", numGenerationErrors, percent(numGenerationErrors, runNumber))
+	reasons := make([]string, 0, len(failureReasons))
+	for reason := range failureReasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Printf("  %s: %d\n", reason, failureReasons[reason])
+	}
 	fmt.Printf("Failed Pod Creations: %d (%.2f%%)\n", failedPodCreate, percent(failedPodCreate, runNumber))
 	fmt.Printf("Ping Errors: %d (%.2f%%)\n", pingErrors, percent(pingErrors, runNumber))
 
@@ -483,42 +592,6 @@ func runKubectl(commandLine string) (string, error) {
 	return string(output), nil
 }
 
-func parseName(blob string) (string, error) {
-	// Find the start index of "metadata:"
-	startIndex := strings.Index(blob, "metadata:")
-	if startIndex == -1 {
-		return "", fmt.Errorf("metadata section not found")
-	}
-
-	// Find the start index of "name:"
-	nameIndex := strings.Index(blob[startIndex:], "name:")
-	if nameIndex == -1 {
-		return "", fmt.Errorf("name field not found")
-	}
-
-	// Adjust nameIndex to start from the beginning of the blob
-	nameIndex += startIndex
-
-	// Find the end index (assuming it ends with a newline character)
-	endIndex := strings.Index(blob[nameIndex:], "\n")
-	if endIndex == -1 {
-		return "", fmt.Errorf("end of name field not found")
-	}
-
-	// Adjust endIndex to start from the beginning of the blob
-	endIndex += nameIndex
-
-	// Extract the name value
-	nameLine := blob[nameIndex:endIndex]
-	parts := strings.Split(nameLine, ":")
-	if len(parts) < 2 {
-		return "", fmt.Errorf("invalid format for name field")
-	}
-
-	// Trim spaces and return the name
-	return strings.TrimSpace(parts[1]), nil
-}
-
 func countLinesofHint(filePath string) (int, error) {
 	// Read the file
 	fileContent, err := ioutil.ReadFile(filePath)
@@ -533,60 +606,107 @@ func countLinesofHint(filePath string) (int, error) {
 	return numLines, nil
 }
 
-func runRobocni(filePath string, llmHost string, llmPort string, llmModel string, introspect bool) (string, int, error) {
+// runRobocni picks a random hint from the file and generates a net-attach-def
+// for it, returning the hint, its line number and the result, which records
+// the attempts made even when generation fails.
+func runRobocni(ctx context.Context, filePath string, opts robocni.Options, hintRand *rand.Rand) (string, int, *robocni.Result, error) {
 	// Read the file
 	fileContent, err := ioutil.ReadFile(filePath)
 	if err != nil {
 		fmt.Printf("Error reading prompts file @ %v: %v\n", filePath, err)
-		return "", -1, err
+		return "", -1, nil, err
 	}
 
 	// Split the file content into lines
 	lines := strings.Split(strings.TrimSpace(string(fileContent)), "\n")
 
-	// Seed the random number generator
-	rand.Seed(time.Now().UnixNano())
-
 	// Select a random line
-	usedlinenumber := rand.Intn(len(lines))
+	usedlinenumber := hintRand.Intn(len(lines))
 	randomLine := lines[usedlinenumber]
 
 	fmt.Println("User hint: ", randomLine)
 
-	var cmd *exec.Cmd
-	// Create the command with flags, depending on if we're introspecting.
-	if introspect {
-		cmd = exec.Command(
-			"robocni",
-			"-host", llmHost,
-			"-model", llmModel,
-			"-port", llmPort,
-			"-routefile", iprouteOutputfile,
-			"-linkfile", ipLinkOutputFile,
-			randomLine, // Add user hint as an argument
-		)
-	} else {
-		cmd = exec.Command(
-			"robocni",
-			"-host", llmHost,
-			"-model", llmModel,
-			"-port", llmPort,
-			randomLine, // Add user hint as an argument
-		)
+	generator, err := robocni.NewGenerator(opts)
+	if err != nil {
+		return randomLine, -1, nil, err
 	}
-	cmd.Env = append(os.Environ(), "OLLAMA_HOST="+llmHost)
+	result, err := generator.Generate(ctx, randomLine)
+	return randomLine, usedlinenumber, result, err
+}
+
+// withSeed returns a copy of the generation options with the seed set.
+func withSeed(options map[string]interface{}, seed int64) map[string]interface{} {
+	seeded := map[string]interface{}{}
+	for name, value := range options {
+		seeded[name] = value
+	}
+	seeded["seed"] = seed
+	return seeded
+}
 
-	var out, stderr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
+// RunRecord is what -recordfile keeps of each run.
+type RunRecord struct {
+	Run    int    `json:"run"`
+	Hint   string `json:"hint"`
+	Seed   int64  `json:"seed"`
+	Name   string `json:"name,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// Succeeded is the number of the attempt that gave the config.
+	Succeeded int             `json:"succeeded,omitempty"`
+	Attempts  []AttemptRecord `json:"attempts,omitempty"`
+}
+
+// AttemptRecord is a single query to the model, with the exact prompt sent
+// and the raw response.
+type AttemptRecord struct {
+	Number   int                   `json:"number"`
+	Prompt   []robocni.ChatMessage `json:"prompt"`
+	Response string                `json:"response,omitempty"`
+	Error    string                `json:"error,omitempty"`
+	Reason   string                `json:"reason,omitempty"`
+}
 
-	err = cmd.Run()
+func newRunRecord(run int, seed int64, hint string, result *robocni.Result, err error) RunRecord {
+	record := RunRecord{Run: run, Hint: hint, Seed: seed, Reason: robocni.FailureReason(err)}
 	if err != nil {
-		fmt.Println("Command: robocni -host", llmHost, "-model", llmModel, "-port", llmPort, randomLine)
-		fmt.Println("Command stderr:", stderr.String())
-		fmt.Println("Command stdout:", out.String())
-		return "", -1, fmt.Errorf("robocni command failed: %w", err)
+		record.Error = err.Error()
+	}
+	if result == nil {
+		return record
+	}
+	record.Name = result.Name
+	if attempt := result.SucceededAttempt(); attempt != nil && err == nil {
+		record.Succeeded = attempt.Number
 	}
+	for _, attempt := range result.Attempts {
+		attemptRecord := AttemptRecord{
+			Number:   attempt.Number,
+			Prompt:   attempt.Prompt,
+			Response: attempt.Response,
+			Reason:   robocni.FailureReason(attempt.Err),
+		}
+		if attempt.Err != nil {
+			attemptRecord.Error = attempt.Err.Error()
+		}
+		record.Attempts = append(record.Attempts, attemptRecord)
+	}
+	return record
+}
 
-	return out.String(), usedlinenumber, nil
+// appendRecord adds the record to the file as a line of JSON.
+func appendRecord(path string, record RunRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// keyValueFlag is a repeatable flag of key=value pairs, like -label app=foo.
+type keyValueFlag map[string]string
+
+func (kv keyValueFlag) String() string {
+	var pairs []string
+	for k, v := range kv {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (kv keyValueFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("%q must be in the form key=value", value)
+	}
+	kv[parts[0]] = parts[1]
+	return nil
+}
+
+// stringListFlag is a repeatable flag collecting every value, like -stop "```".
+type stringListFlag []string
+
+func (l *stringListFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringListFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// Get returns the values, for flag.Getter.
+func (l *stringListFlag) Get() interface{} {
+	return []string(*l)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+)
+
+// optionFlags map the flags setting generation options to the names of the
+// Ollama options.
+var optionFlags = map[string]string{
+	"temperature": "temperature",
+	"seed":        "seed",
+	"top-p":       "top_p",
+	"top-k":       "top_k",
+	"num-ctx":     "num_ctx",
+	"num-predict": "num_predict",
+	"stop":        "stop",
+}
+
+// generationOptions merges the options of the profile with the option flags
+// given on the command line, which take precedence.
+func generationOptions(fs *flag.FlagSet, set map[string]bool, profileOptions map[string]interface{}) map[string]interface{} {
+	options := map[string]interface{}{}
+	for name, value := range profileOptions {
+		options[name] = value
+	}
+	for flagName, option := range optionFlags {
+		if !set[flagName] {
+			continue
+		}
+		if getter, ok := fs.Lookup(flagName).Value.(flag.Getter); ok {
+			options[option] = getter.Get()
+		}
+	}
+	if len(options) == 0 {
+		return nil
+	}
+	return options
+}
@@ -1,346 +1,305 @@
 package main
 
 import (
-	"bytes"
-	"embed"
-	"encoding/json"
-	"errors"
+	"context"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"os"
-	"strings"
-	"text/template"
-)
-
-// Define a struct to unmarshal the JSON response
-type LLMResponse struct {
-	Model     string `json:"model"`
-	CreatedAt string `json:"created_at"`
-	Response  string `json:"response"`
-	Done      bool   `json:"done"`
-}
-
-// Embed the file
-//
-//go:embed templates/base_query.txt
-var basequeryBlob embed.FS
+	"os/signal"
+	"syscall"
+	"time"
 
-//go:embed templates/netattachdef_template.txt
-var netattachdefBlob embed.FS
-
-// Template Structs
-type QueryTemplateData struct {
-	Interfaces string
-	Routes     string
-	Hint       string
-}
-
-type NetAttachDefTemplateData struct {
-	CNIConfig string
-	CNIName   string
-}
+	"github.com/dougbtv/robocniconfig/pkg/config"
+	"github.com/dougbtv/robocniconfig/pkg/robocni"
+)
 
 func main() {
 
+	// "robocni serve" runs the HTTP API instead of generating a single config.
+	serveMode := len(os.Args) > 1 && os.Args[1] == "serve"
+
 	// Define flags
+	configPath := flag.String("config", "", "Path of the config file (defaults to "+config.DefaultPath()+")")
+	profileName := flag.String("profile", "", "Profile of the config file to use (defaults to the config's defaultProfile)")
 	useJsonOutput := flag.Bool("json", false, "Output just the CNI json instead of a net-attach-def")
+	nadFormat := flag.String("output", "yaml", "Format of the net-attach-def: yaml or json")
+	useCompact := flag.Bool("compact", false, "Compact the CNI json onto a single line")
+	nadNamespace := flag.String("namespace", "", "Namespace of the net-attach-def (defaults to a namespace named in the hint, if any)")
+	nadLabels := keyValueFlag{}
+	flag.Var(nadLabels, "label", "Label to add to the net-attach-def as key=value, can be repeated")
+	nadAnnotations := keyValueFlag{}
+	flag.Var(nadAnnotations, "annotation", "Annotation to add to the net-attach-def as key=value, can be repeated")
+	noProvenance := flag.Bool("no-provenance", false, "Don't annotate the net-attach-def with the hint, model, provider and generation time")
 	useDebug := flag.Bool("debug", false, "Show debug output, especially entire response from LLM")
+	useStream := flag.Bool("stream", false, "Show the progress of the LLM's reply as it streams in (the reply itself with -debug), and stop it once it holds a complete JSON object or block. Only Ollama streams")
+	llmProvider := flag.String("provider", "ollama", "The LLM provider API to use, one of: ollama, openai (any OpenAI-compatible server such as vLLM, llama.cpp server or LocalAI)")
 	ollamaHost := flag.String("host", "", "The IP address of the ollama host")
 	ollamaPort := flag.String("port", "11434", "The port address of the ollama service")
+	llmEndpoint := flag.String("endpoint", "", "Base URL of the LLM service (e.g. http://localhost:8000), overrides -host and -port")
+	llmAPIKey := flag.String("apikey", "", "API key sent as a bearer token to OpenAI-compatible providers (defaults to OPENAI_API_KEY)")
 	ollamaModel := flag.String("model", "llama2:13b", "The port address of the ollama service")
+	connectTimeout := flag.Duration("connect-timeout", robocni.DefaultConnectTimeout, "Give up connecting to the LLM service after this long, 0 for no limit")
+	queryTimeout := flag.Duration("timeout", robocni.DefaultTimeout, "Give up on a query to the LLM, including generating the reply, after this long, 0 for no limit")
+	maxRetries := flag.Int("retries", robocni.DefaultRetries, "Number of times to retry a query that couldn't reach the LLM service, backing off exponentially")
 	fileRoutes := flag.String("routefile", "", "File containing the output of 'ip route' command")
 	fileIPLinkShow := flag.String("linkfile", "", "File containing the output of 'ip link show' command")
+	fixMaster := flag.Bool("fix-master", true, "Replace a master interface that doesn't exist on the host, is a veth or bridge member, or is down, instead of rejecting the config")
+	introspectLocalHost := flag.Bool("introspect-local", false, "Read the interfaces and routes of this host with netlink, instead of using -linkfile and -routefile")
+	outputFormatName := flag.String("format", "schema", "Constrain the LLM output: schema (CNI config JSON schema), json (any JSON) or none. Providers that can't constrain output fall back to backtick-enclosed JSON")
+	generatorMode := flag.String("generator", "auto", "How to generate the config: auto (rules for structured hints like 'type=macvlan master=eth0', otherwise the LLM), rules or llm")
+	promptTemplate := flag.String("prompt-template", "", "Path of a template to use instead of the built in system prompt")
+	templateDir := flag.String("template-dir", "", "Directory of templates (system_prompt.txt, query.txt, cni_schema.json) and examples/*.txt overriding the built in ones")
+	exampleSelection := flag.String("example-selection", "keyword", "How to pick the examples shown to the LLM: keyword (plugins and IPAM named in the hint), embedding (similarity using -embed-model) or all")
+	maxExamples := flag.Int("examples", 3, "Maximum number of examples shown to the LLM, 0 for no limit")
+	embedModel := flag.String("embed-model", robocni.DefaultEmbedModel, "The Ollama model used for -example-selection embedding")
+	flag.Float64("temperature", 0, "Sampling temperature, lower is more deterministic (defaults to the model's)")
+	flag.Int("seed", 0, "Random seed, to make the output reproducible (defaults to the model's)")
+	flag.Float64("top-p", 0, "Nucleus sampling probability (defaults to the model's)")
+	flag.Int("top-k", 0, "Sample from the k most likely tokens (defaults to the model's)")
+	flag.Int("num-ctx", 0, "Size of the context window in tokens (defaults to the model's)")
+	flag.Int("num-predict", 0, "Maximum number of tokens to generate (defaults to the model's)")
+	var stopSequences stringListFlag
+	flag.Var(&stopSequences, "stop", "Stop generating at this sequence, can be repeated (defaults to the model's)")
+	numCandidates := flag.Int("candidates", 1, "Generate this many candidate configs and pick the one most of them agree on")
+	parallelCandidates := flag.Int("parallel", 1, "How many candidates to generate at the same time")
+	cacheDir := flag.String("cache-dir", robocni.DefaultCacheDir(), "Directory of the response cache")
+	noCache := flag.Bool("no-cache", false, "Neither use nor update the response cache")
+	refreshCache := flag.Bool("refresh-cache", false, "Query the model even if the response is cached, and cache the new response")
+	pruneCache := flag.Duration("prune-cache", 0, "Remove cached responses older than this (e.g. 168h), 0 removes them all. Runs without a hint just prune")
+	maxAttempts := flag.Int("attempts", robocni.DefaultAttempts, "Number of times to query the LLM for a valid configuration, feeding back the error each time")
 	help := flag.Bool("help", false, "Display help information")
 
+	var server ServerSettings
+	if serveMode {
+		flag.StringVar(&server.Listen, "listen", ":8080", "Address for the API to listen on")
+		flag.DurationVar(&server.RequestTimeout, "request-timeout", 5*time.Minute, "Maximum time to handle a generate request")
+		flag.IntVar(&server.MaxConcurrent, "max-concurrent", 2, "Maximum number of generate requests handled at the same time, others are refused")
+		flag.IntVar(&server.MaxAttempts, "max-attempts", 10, "Maximum number of attempts a request can ask for")
+		flag.IntVar(&server.MaxCandidates, "max-candidates", 5, "Maximum number of candidates a request can ask for")
+	}
+
 	// Parse the flags
-	flag.Parse()
+	if serveMode {
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
 
 	// Check if help was requested
 	if *help {
-		logErr("Usage of robocni:")
+		if serveMode {
+			logErr("Usage of robocni serve:")
+		} else {
+			logErr("Usage of robocni:")
+		}
 		flag.PrintDefaults() // This will print out all defined flags
 		os.Exit(0)
 	}
 
-	// Get non-flag arguments
-	args := flag.Args()
-	if len(args) == 0 {
-		logErr("You must provide a 'hint' as the last parameter, for example run it like: './robocni \"Use bridge CNI and whereabouts CNI with 192.168.50.0/24 range\"'")
+	// Anything not given on the command line comes from the config file
+	// profile, except the host, which OLLAMA_HOST overrides.
+	setFlags := config.SetFlags(flag.CommandLine)
+	if !setFlags["host"] && os.Getenv("OLLAMA_HOST") != "" {
+		*ollamaHost = os.Getenv("OLLAMA_HOST")
+		setFlags["host"] = true
+	}
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		logErr(fmt.Sprintf("%v", err))
 		os.Exit(1)
 	}
-
-	// The last positional argument
-	userHint := args[len(args)-1]
-
-	if *ollamaHost == "" {
-		*ollamaHost = os.Getenv("OLLAMA_HOST")
-		if *ollamaHost == "" {
-			logErr("Please set --host or the OLLAMA_HOST environment variable.")
-			os.Exit(1)
+	profile, err := cfg.Profile(*profileName)
+	if err != nil {
+		logErr(fmt.Sprintf("%v", err))
+		os.Exit(1)
+	}
+	if err := config.Apply(flag.CommandLine, setFlags, profile.FlagValues()); err != nil {
+		logErr(fmt.Sprintf("%v", err))
+		os.Exit(1)
+	}
+	for k, v := range profile.Labels {
+		if _, ok := nadLabels[k]; !ok {
+			nadLabels[k] = v
 		}
 	}
-
-	// Introspect the Host
-	// logErr("Listing Network Interfaces:")
-
-	var ifs, routes string
-	// Check and read the interface file if provided
-	if *fileIPLinkShow != "" {
-		if _, err := os.Stat(*fileIPLinkShow); os.IsNotExist(err) {
-			fmt.Printf("Error: file %s does not exist\n", *fileIPLinkShow)
-			os.Exit(1)
-		} else {
-			content, err := ioutil.ReadFile(*fileIPLinkShow)
-			if err != nil {
-				fmt.Printf("Error reading IP address file %s: %v\n", *fileIPLinkShow, err)
-				os.Exit(1)
-			}
-			ifs = string(content)
+	for k, v := range profile.Annotations {
+		if _, ok := nadAnnotations[k]; !ok {
+			nadAnnotations[k] = v
 		}
 	}
 
-	// Check and read the route file if provided
-	if *fileRoutes != "" {
-		if _, err := os.Stat(*fileRoutes); os.IsNotExist(err) {
-			fmt.Printf("Error: file %s does not exist\n", *fileRoutes)
-			os.Exit(1)
-		} else {
-			content, err := ioutil.ReadFile(*fileRoutes)
-			if err != nil {
-				fmt.Printf("Error reading routes file %s: %v\n", *fileRoutes, err)
-				os.Exit(1)
-			}
-			routes = string(content)
-		}
+	if *nadFormat != "yaml" && *nadFormat != "json" {
+		logErr("The -output format must be one of: yaml, json")
+		os.Exit(1)
 	}
 
-	data := QueryTemplateData{
-		Interfaces: ifs,
-		Routes:     routes,
-		Hint:       userHint,
+	if *nadNamespace != "" && !robocni.ValidNamespace(*nadNamespace) {
+		logErr(fmt.Sprintf("The namespace %q is not a valid DNS-1123 name", *nadNamespace))
+		os.Exit(1)
 	}
-	var extractedjson, cniname string
-	found := false
-	for i := 0; i < 5; i++ {
 
-		// Step 2: Query the LLM
-		query := templateQuery(data)
-		response, err := queryLLM(*ollamaHost, *ollamaPort, *ollamaModel, *useDebug, query)
+	cache := &robocni.ResponseCache{Dir: *cacheDir}
+	if setFlags["prune-cache"] {
+		removed, err := cache.Prune(*pruneCache)
 		if err != nil {
 			logErr(fmt.Sprintf("%v", err))
-		} else {
-			// logErr("!bang LLM Response:", response)
+			os.Exit(1)
 		}
-
-		extractedjson, cniname, err = parseAndValidateJSON(response)
-		if err != nil {
-			logErr(fmt.Sprintf("Attempt %d/5 failed: %v", i+1, err))
-			continue
+		logErr(fmt.Sprintf("Pruned %d cached responses", removed))
+		if flag.NArg() == 0 && !serveMode {
+			os.Exit(0)
 		}
-
-		found = true
-		break
-
-	}
-
-	if !found {
-		logErr("LLM Query failed in 5 tries :( #failburger")
-		os.Exit(1)
-	}
-
-	// logErr(fmt.Sprintf("Generating net-attach-def for: %v", cniname))
-	// logErr("Valid JSON:", extractedjson)
-
-	netattachdefdata := NetAttachDefTemplateData{
-		CNIName:   cniname,
-		CNIConfig: strings.TrimSpace(extractedjson),
 	}
-
-	renderednetattachdef := templateNetAttachDef(netattachdefdata)
-
-	// Just output the net-attach-def, or, JSON if requested
-	if *useJsonOutput {
-		fmt.Printf(extractedjson)
-	} else {
-		fmt.Printf(renderednetattachdef)
-		os.Exit(0)
-	}
-
-}
-
-func logErr(str string) {
-	fmt.Fprintln(os.Stderr, str)
-}
-
-func parseAndValidateJSON(response string) (string, string, error) {
-	// Find the start of the code block, supporting both ``` and ```json
-	start := strings.Index(response, "```")
-	if start == -1 {
-		return "", "", errors.New("no valid backtick-enclosed text found")
+	if *noCache || cache.Dir == "" {
+		cache = nil
 	}
 
-	// Adjust the start index if it's ```json
-	startOffset := 3
-	if strings.HasPrefix(response[start:], "```json") {
-		startOffset = 7
+	if *llmAPIKey == "" {
+		*llmAPIKey = os.Getenv("OPENAI_API_KEY")
 	}
 
-	// Find the end of the code block
-	end := strings.LastIndex(response, "```")
-	if end == -1 || start == end {
-		return "", "", errors.New("no valid backtick-enclosed text found")
+	// Without a host, only hints the rules can handle work.
+	client := robocni.NewHTTPClient(*connectTimeout, *queryTimeout)
+	newLLMProvider := func(model string) (robocni.LLMProvider, error) {
+		if *ollamaHost == "" && *llmEndpoint == "" {
+			return nil, nil
+		}
+		return robocni.NewProvider(*llmProvider, *llmEndpoint, *ollamaHost, *ollamaPort, model, *llmAPIKey, client)
 	}
-
-	// Extract text between backticks
-	jsonStr := response[start+startOffset : end]
-
-	// Unmarshal the JSON into a map
-	var dataMap map[string]interface{}
-	err := json.Unmarshal([]byte(jsonStr), &dataMap)
+	provider, err := newLLMProvider(*ollamaModel)
 	if err != nil {
-		return "", "", fmt.Errorf("invalid JSON: %v", err)
-	}
-
-	// Extract the "name" field
-	name, ok := dataMap["name"].(string)
-	if !ok {
-		return "", "", errors.New("name field not found or not a string")
+		logErr(fmt.Sprintf("%v", err))
+		os.Exit(1)
 	}
 
-	return jsonStr, name, nil
-}
-
-func templateQuery(data QueryTemplateData) string {
-	// Read the embedded template file
-	tmpl, err := basequeryBlob.ReadFile("templates/base_query.txt")
-	if err != nil {
-		panic(err)
+	// Introspect the Host
+	if *introspectLocalHost && (*fileIPLinkShow != "" || *fileRoutes != "") {
+		logErr("-introspect-local can't be used with -linkfile or -routefile")
+		os.Exit(1)
 	}
-
-	// Parse the template
-	t, err := template.New("template").Parse(string(tmpl))
+	host, ifs, routes, err := loadHost(*introspectLocalHost, *fileIPLinkShow, *fileRoutes)
 	if err != nil {
-		panic(err)
+		logErr(fmt.Sprintf("%v", err))
+		os.Exit(1)
 	}
 
-	// Execute the template with the data
-	var tpl bytes.Buffer
-	err = t.Execute(&tpl, data)
-	if err != nil {
-		panic(err)
+	opts := robocni.Options{
+		Generator:        *generatorMode,
+		Provider:         provider,
+		Model:            *ollamaModel,
+		Host:             host,
+		RawInterfaces:    ifs,
+		RawRoutes:        routes,
+		FixMaster:        *fixMaster,
+		Format:           *outputFormatName,
+		Templates:        robocni.Templates{Dir: *templateDir, SystemPrompt: *promptTemplate},
+		ExampleSelection: *exampleSelection,
+		EmbedModel:       *embedModel,
+		MaxExamples:      *maxExamples,
+		Options:          generationOptions(flag.CommandLine, setFlags, profile.Options),
+		MaxAttempts:      *maxAttempts,
+		Retries:          *maxRetries,
+		Candidates:       *numCandidates,
+		Parallel:         *parallelCandidates,
+		Cache:            cache,
+		RefreshCache:     *refreshCache,
+		Namespace:        *nadNamespace,
+		Labels:           nadLabels,
+		Annotations:      nadAnnotations,
+		NoProvenance:     *noProvenance,
+		Compact:          *useCompact,
+		Log:              logErr,
+		Debug:            *useDebug,
 	}
 
-	// Print the result
-	// logErr(tpl.String())
-	return tpl.String()
-}
-
-func templateNetAttachDef(data NetAttachDefTemplateData) string {
-	// Read the embedded template file
-	tmpl, err := netattachdefBlob.ReadFile("templates/netattachdef_template.txt")
-	if err != nil {
-		panic(err)
+	if *useStream && !serveMode {
+		progress := &streamProgress{debug: *useDebug}
+		opts.Stream, opts.Log = progress.Token, progress.Log
 	}
 
-	// Parse the template
-	t, err := template.New("template").Parse(string(tmpl))
-	if err != nil {
-		panic(err)
+	if serveMode {
+		if err := serve(server, opts, newLLMProvider); err != nil {
+			logErr(fmt.Sprintf("%v", err))
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
 
-	// Execute the template with the data
-	var tpl bytes.Buffer
-	err = t.Execute(&tpl, data)
-	if err != nil {
-		panic(err)
+	// Get non-flag arguments
+	args := flag.Args()
+	if len(args) == 0 {
+		logErr("You must provide a 'hint' as the last parameter, for example run it like: './robocni \"Use bridge CNI and whereabouts CNI with 192.168.50.0/24 range\"'")
+		os.Exit(1)
 	}
 
-	// Print the result
-	// logErr(tpl.String())
-	return tpl.String()
-}
-
-// func listNetworkInterfaces() (string, error) {
-// 	interfaces, err := net.Interfaces()
-// 	if err != nil {
-// 		logErr(fmt.Sprintf("%v", err))
-// 		return "", fmt.Errorf("error listing interfaces: %v", err)
-// 	}
-
-// 	var result string
-// 	for _, intf := range interfaces {
-// 		result += fmt.Sprintf("%v\n", intf.Name)
-// 		// Add more details as needed
-// 	}
-
-// 	return result, nil
-// }
-
-// func getIPRoute() (string, error) {
-// 	cmd := exec.Command("ip", "route")
-// 	var out bytes.Buffer
-// 	cmd.Stdout = &out
-// 	err := cmd.Run()
-// 	if err != nil {
-// 		return "", err
-// 	}
-// 	return out.String(), nil
-// }
+	// The last positional argument
+	userHint := args[len(args)-1]
 
-func queryLLM(ollamaHost string, ollamaPort string, ollamaModel string, usedebug bool, query string) (string, error) {
-	// Define the URL and payload
-	url := "http://" + ollamaHost + ":" + ollamaPort + "/api/generate"
-	payload := map[string]string{"model": ollamaModel, "prompt": query}
-	payloadBytes, err := json.Marshal(payload)
+	generator, err := robocni.NewGenerator(opts)
 	if err != nil {
-		return "", fmt.Errorf("error marshalling payload: %v", err)
+		logErr(fmt.Sprintf("%v", err))
+		os.Exit(1)
+	}
+	// Ctrl-C stops querying the LLM.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	result, err := generator.Generate(ctx, userHint)
+	// opts.Log, as it ends any line of streaming progress.
+	if ctx.Err() != nil {
+		opts.Log("Interrupted")
+		os.Exit(130)
 	}
-	body := bytes.NewReader(payloadBytes)
-
-	// Make the POST request
-	req, err := http.NewRequest("POST", url, body)
 	if err != nil {
-		return "", fmt.Errorf("error creating POST request: %v", err)
+		opts.Log(fmt.Sprintf("%v", err))
+		os.Exit(1)
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	// Perform the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("error performing POST request: %v", err)
+	// Just output the CNI JSON if requested
+	if *useJsonOutput {
+		normalized, err := robocni.NormalizeJSON(result.Config, *useCompact)
+		if err != nil {
+			logErr(fmt.Sprintf("%v", err))
+			os.Exit(1)
+		}
+		fmt.Println(normalized)
+		os.Exit(0)
 	}
-	defer resp.Body.Close()
 
-	// Read the response body
-	responseBody, err := ioutil.ReadAll(resp.Body)
+	// Otherwise, the net-attach-def
+	renderednetattachdef, err := robocni.RenderNetAttachDef(result.NetAttachDef, *nadFormat == "json")
 	if err != nil {
-		return "", fmt.Errorf("error reading response body: %v", err)
+		logErr(fmt.Sprintf("%v", err))
+		os.Exit(1)
 	}
+	fmt.Print(renderednetattachdef)
 
-	// Split the response body into lines and process each line
-	var finalResponse string
-	lines := strings.Split(string(responseBody), "\n")
-	for _, line := range lines {
-		if line == "" {
-			continue
-		}
+}
 
-		var response LLMResponse
-		err = json.Unmarshal([]byte(line), &response)
+// loadHost reads the host's networking with netlink, or from the ip link and
+// ip route dumps in linkFile and routeFile. Dumps that can't be parsed are
+// returned as is, to give to the LLM.
+func loadHost(introspect bool, linkFile string, routeFile string) (*robocni.HostNetwork, string, string, error) {
+	if introspect {
+		host, err := robocni.IntrospectLocal()
 		if err != nil {
-			return "", fmt.Errorf("error unmarshalling response JSON line: %v", err)
+			return nil, "", "", fmt.Errorf("error introspecting the host network: %v", err)
 		}
-
-		finalResponse += response.Response
+		return host, "", "", nil
 	}
 
-	if usedebug {
-		logErr(strings.TrimSpace(finalResponse))
-		// logErr("---")
-		// logErr(string(responseBody))
+	host, ifs, routes, err := robocni.ReadHostFiles(linkFile, routeFile)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if ifs != "" {
+		logErr(fmt.Sprintf("Couldn't parse %s, giving it to the LLM as is", linkFile))
 	}
-	return strings.TrimSpace(finalResponse), nil
+	if routes != "" {
+		logErr(fmt.Sprintf("Couldn't parse %s, giving it to the LLM as is", routeFile))
+	}
+	return host, ifs, routes, nil
+}
+
+func logErr(str string) {
+	fmt.Fprintln(os.Stderr, str)
 }
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dougbtv/robocniconfig/pkg/robocni"
+)
+
+// ServerSettings are the flags of "robocni serve".
+type ServerSettings struct {
+	Listen         string
+	RequestTimeout time.Duration
+	MaxConcurrent  int
+	// MaxAttempts and MaxCandidates limit what a request can ask for.
+	MaxAttempts   int
+	MaxCandidates int
+}
+
+// GenerateRequest is the body of POST /v1/generate. Fields left out use the
+// server's flags.
+type GenerateRequest struct {
+	Hint        string                 `json:"hint"`
+	Model       string                 `json:"model,omitempty"`
+	Generator   string                 `json:"generator,omitempty"`
+	Format      string                 `json:"format,omitempty"`
+	Attempts    int                    `json:"attempts,omitempty"`
+	Candidates  int                    `json:"candidates,omitempty"`
+	Options     map[string]interface{} `json:"options,omitempty"`
+	Namespace   string                 `json:"namespace,omitempty"`
+	Labels      map[string]string      `json:"labels,omitempty"`
+	Annotations map[string]string      `json:"annotations,omitempty"`
+	// Interfaces and Routes are the output of ip link and ip route on the
+	// node the config is for, replacing the server's host data.
+	Interfaces string `json:"interfaces,omitempty"`
+	Routes     string `json:"routes,omitempty"`
+	NoCache    bool   `json:"noCache,omitempty"`
+}
+
+// GenerateResponse is the reply to POST /v1/generate.
+type GenerateResponse struct {
+	Error        string            `json:"error,omitempty"`
+	Name         string            `json:"name,omitempty"`
+	Config       json.RawMessage   `json:"config,omitempty"`
+	NetAttachDef string            `json:"netAttachDef,omitempty"`
+	GeneratedBy  string            `json:"generatedBy,omitempty"`
+	Examples     []string          `json:"examples,omitempty"`
+	Confidence   float64           `json:"confidence,omitempty"`
+	CacheHit     bool              `json:"cacheHit,omitempty"`
+	Validation   *ValidationReport `json:"validation,omitempty"`
+	Attempts     []AttemptReport   `json:"attempts,omitempty"`
+}
+
+// ValidationReport says whether a valid config was generated, what was
+// corrected in it, or else why the last answer was rejected.
+type ValidationReport struct {
+	Valid       bool                      `json:"valid"`
+	Corrections []string                  `json:"corrections,omitempty"`
+	Errors      []robocni.ValidationError `json:"errors,omitempty"`
+}
+
+// AttemptReport is an Attempt in a GenerateResponse.
+type AttemptReport struct {
+	Candidate   int      `json:"candidate,omitempty"`
+	Number      int      `json:"number"`
+	Response    string   `json:"response,omitempty"`
+	Error       string   `json:"error,omitempty"`
+	Corrections []string `json:"corrections,omitempty"`
+}
+
+// serve runs the HTTP API until it fails.
+func serve(settings ServerSettings, opts robocni.Options, newLLMProvider func(model string) (robocni.LLMProvider, error)) error {
+	handler, err := apiHandler(settings, opts, newLLMProvider)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Addr:              settings.Listen,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	logErr(fmt.Sprintf("Serving the robocni API on %s", settings.Listen))
+	return server.ListenAndServe()
+}
+
+// apiHandler serves the API. Requests are generated with opts, overridden by
+// the request, using a provider for the requested model.
+func apiHandler(settings ServerSettings, opts robocni.Options, newLLMProvider func(model string) (robocni.LLMProvider, error)) (http.Handler, error) {
+	if settings.MaxConcurrent < 1 {
+		return nil, errors.New("-max-concurrent must be at least 1")
+	}
+	if settings.MaxAttempts < 1 || settings.MaxCandidates < 1 {
+		return nil, errors.New("-max-attempts and -max-candidates must be at least 1")
+	}
+	slots := make(chan struct{}, settings.MaxConcurrent)
+
+	generateHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, GenerateResponse{Error: "use POST"})
+			return
+		}
+
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		default:
+			writeJSON(w, http.StatusTooManyRequests, GenerateResponse{Error: "too many requests in progress, try again later"})
+			return
+		}
+
+		var request GenerateRequest
+		r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeJSON(w, http.StatusBadRequest, GenerateResponse{Error: fmt.Sprintf("error parsing request: %v", err)})
+			return
+		}
+
+		requestOpts, err := requestOptions(settings, opts, request, newLLMProvider)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, GenerateResponse{Error: err.Error()})
+			return
+		}
+		generator, err := robocni.NewGenerator(requestOpts)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, GenerateResponse{Error: err.Error()})
+			return
+		}
+
+		start := time.Now()
+		result, err := generator.Generate(r.Context(), request.Hint)
+		status, response := generateResponse(result, err)
+		logErr(fmt.Sprintf("POST /v1/generate %d in %s: %q", status, time.Since(start).Round(time.Millisecond), request.Hint))
+		writeJSON(w, status, response)
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/v1/generate", http.TimeoutHandler(generateHandler, settings.RequestTimeout, `{"error":"the request timed out"}`))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	return mux, nil
+}
+
+// requestOptions applies the request to the server's options.
+func requestOptions(settings ServerSettings, opts robocni.Options, request GenerateRequest, newLLMProvider func(model string) (robocni.LLMProvider, error)) (robocni.Options, error) {
+	if request.Hint == "" {
+		return opts, errors.New("the hint is required")
+	}
+	if request.Attempts < 0 || request.Candidates < 0 {
+		return opts, errors.New("attempts and candidates can't be negative")
+	}
+	if request.Attempts > settings.MaxAttempts {
+		return opts, fmt.Errorf("attempts can be at most %d", settings.MaxAttempts)
+	}
+	if request.Candidates > settings.MaxCandidates {
+		return opts, fmt.Errorf("candidates can be at most %d", settings.MaxCandidates)
+	}
+	if request.Model != "" && request.Model != opts.Model {
+		provider, err := newLLMProvider(request.Model)
+		if err != nil {
+			return opts, err
+		}
+		opts.Provider, opts.Model = provider, request.Model
+	}
+	if request.Generator != "" {
+		opts.Generator = request.Generator
+	}
+	if request.Format != "" {
+		opts.Format = request.Format
+	}
+	if request.Attempts != 0 {
+		opts.MaxAttempts = request.Attempts
+	}
+	if request.Candidates != 0 {
+		opts.Candidates = request.Candidates
+	}
+	if request.Options != nil {
+		opts.Options = request.Options
+	}
+	if request.Namespace != "" {
+		opts.Namespace = request.Namespace
+	}
+	opts.Labels = mergeMaps(opts.Labels, request.Labels)
+	opts.Annotations = mergeMaps(opts.Annotations, request.Annotations)
+	if request.NoCache {
+		opts.Cache = nil
+	}
+
+	if request.Interfaces != "" || request.Routes != "" {
+		opts.Host, opts.RawInterfaces, opts.RawRoutes = &robocni.HostNetwork{}, "", ""
+		var err error
+		if opts.Host.Interfaces, err = robocni.ParseIPLink(request.Interfaces); err != nil {
+			opts.RawInterfaces = request.Interfaces
+		}
+		if opts.Host.Routes, err = robocni.ParseIPRoute(request.Routes); err != nil {
+			opts.RawRoutes = request.Routes
+		}
+	}
+
+	return opts, nil
+}
+
+// generateResponse turns the outcome of generate into the reply and its status.
+func generateResponse(result *robocni.Result, err error) (int, GenerateResponse) {
+	var response GenerateResponse
+	report := &ValidationReport{}
+	if result != nil {
+		response.GeneratedBy = result.GeneratedBy
+		response.Examples = result.Examples
+		response.CacheHit = result.CacheHit
+		for _, attempt := range result.Attempts {
+			attemptReport := AttemptReport{
+				Candidate:   attempt.Candidate,
+				Number:      attempt.Number,
+				Response:    attempt.Response,
+				Corrections: attempt.Corrections,
+			}
+			if attempt.Err != nil {
+				attemptReport.Error = attempt.Err.Error()
+			}
+			response.Attempts = append(response.Attempts, attemptReport)
+		}
+	}
+
+	if err != nil {
+		response.Error = err.Error()
+		var queryErr *robocni.QueryError
+		var validationErrs robocni.ValidationErrors
+		var generationErr *robocni.GenerationError
+		var rulesErr *robocni.RulesError
+		switch {
+		case errors.As(err, &queryErr):
+			// The model couldn't be queried, so there is nothing to validate.
+			return http.StatusBadGateway, response
+		case errors.Is(err, robocni.ErrNeedsLLM):
+			// The server has no LLM to ask.
+			return http.StatusServiceUnavailable, response
+		case errors.As(err, &validationErrs):
+			// Report why the last answer was rejected.
+			report.Errors = validationErrs
+		case errors.As(err, &generationErr):
+			if generationErr.Unwrap() != nil {
+				report.Errors = []robocni.ValidationError{{Message: generationErr.Unwrap().Error()}}
+			}
+		case errors.As(err, &rulesErr):
+			report.Errors = []robocni.ValidationError{{Message: rulesErr.Error()}}
+		default:
+			// Something the server needs, like its templates, is broken.
+			return http.StatusServiceUnavailable, response
+		}
+		response.Validation = report
+		return http.StatusUnprocessableEntity, response
+	}
+
+	report.Valid = true
+	report.Corrections = result.Corrections
+	response.Validation = report
+	response.Name = result.Name
+	response.Config = json.RawMessage(result.Config)
+	response.Confidence = result.Confidence
+	response.NetAttachDef, err = robocni.RenderNetAttachDef(result.NetAttachDef, false)
+	if err != nil {
+		return http.StatusInternalServerError, GenerateResponse{Error: err.Error()}
+	}
+	return http.StatusOK, response
+}
+
+func mergeMaps(base map[string]string, overrides map[string]string) map[string]string {
+	merged := map[string]string{}
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range overrides {
+		merged[k] = v
+	}
+	return merged
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logErr(fmt.Sprintf("Error writing response: %v", err))
+	}
+}
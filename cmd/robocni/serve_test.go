@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dougbtv/robocniconfig/pkg/robocni"
+)
+
+// replyProvider always gives the same reply.
+type replyProvider string
+
+func (p replyProvider) Name() string         { return "reply" }
+func (p replyProvider) SupportsFormat() bool { return true }
+
+func (p replyProvider) Chat(ctx context.Context, request robocni.ChatRequest) (string, error) {
+	return string(p), nil
+}
+
+// failingProvider can't be queried.
+type failingProvider struct{}
+
+func (p failingProvider) Name() string         { return "failing" }
+func (p failingProvider) SupportsFormat() bool { return true }
+
+func (p failingProvider) Chat(ctx context.Context, request robocni.ChatRequest) (string, error) {
+	return "", errors.New("connection refused")
+}
+
+// blockingProvider replies once it's released, after telling it was called.
+type blockingProvider struct {
+	called  chan struct{}
+	release chan struct{}
+}
+
+func (p blockingProvider) Name() string         { return "blocking" }
+func (p blockingProvider) SupportsFormat() bool { return true }
+
+func (p blockingProvider) Chat(ctx context.Context, request robocni.ChatRequest) (string, error) {
+	p.called <- struct{}{}
+	<-p.release
+	return "", errors.New("released")
+}
+
+const validReply = `{"cniVersion": "0.3.1", "name": "mv", "type": "macvlan", "master": "eth0", "mode": "bridge", "ipam": {"type": "dhcp"}}`
+
+var testSettings = ServerSettings{RequestTimeout: time.Minute, MaxConcurrent: 1, MaxAttempts: 3, MaxCandidates: 3}
+
+func testOptions(provider robocni.LLMProvider) robocni.Options {
+	return robocni.Options{
+		Generator:        "auto",
+		Provider:         provider,
+		Model:            "test",
+		Format:           "json",
+		ExampleSelection: "keyword",
+		MaxExamples:      3,
+		MaxAttempts:      1,
+		Candidates:       1,
+		Parallel:         1,
+		FixMaster:        true,
+		NoProvenance:     true,
+	}
+}
+
+// newLLMProvider only knows the "other" model.
+func newLLMProvider(model string) (robocni.LLMProvider, error) {
+	if model != "other" {
+		return nil, errors.New("unknown model")
+	}
+	return replyProvider(validReply), nil
+}
+
+func TestAPIHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider robocni.LLMProvider
+		method   string
+		body     string
+		want     int
+		// wantFields are the fields of the validation errors.
+		wantFields []string
+	}{
+		{
+			name:     "config from the LLM",
+			provider: replyProvider(validReply),
+			body:     `{"hint": "a macvlan for my database pods"}`,
+			want:     http.StatusOK,
+		},
+		{
+			name: "config from rules without an LLM",
+			body: `{"hint": "type=macvlan master=eth0 whereabouts=10.30.0.0/24"}`,
+			want: http.StatusOK,
+		},
+		{
+			name:     "requested model",
+			provider: replyProvider("not JSON"),
+			body:     `{"hint": "a macvlan for my database pods", "model": "other"}`,
+			want:     http.StatusOK,
+		},
+		{
+			name:   "GET",
+			method: http.MethodGet,
+			want:   http.StatusMethodNotAllowed,
+		},
+		{
+			name: "invalid JSON",
+			body: `{"hint": `,
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "no hint",
+			body: `{}`,
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "too many attempts",
+			body: `{"hint": "a macvlan", "attempts": 4}`,
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "too many candidates",
+			body: `{"hint": "a macvlan", "candidates": 4}`,
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "negative attempts",
+			body: `{"hint": "a macvlan", "attempts": -1}`,
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "unknown generator",
+			body: `{"hint": "a macvlan", "generator": "magic"}`,
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "unknown format",
+			body: `{"hint": "a macvlan", "format": "yaml"}`,
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "unknown model",
+			body: `{"hint": "a macvlan", "model": "missing"}`,
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "invalid namespace",
+			body: `{"hint": "a macvlan", "namespace": "Not_Valid"}`,
+			want: http.StatusBadRequest,
+		},
+		{
+			name:       "rejected answer",
+			provider:   replyProvider(strings.Replace(validReply, `"bridge"`, `"l2"`, 1)),
+			body:       `{"hint": "a macvlan for my database pods"}`,
+			want:       http.StatusUnprocessableEntity,
+			wantFields: []string{"mode"},
+		},
+		{
+			name: "rules can't build the config",
+			body: `{"hint": "type=vlan vlan=100", "generator": "rules"}`,
+			want: http.StatusUnprocessableEntity,
+		},
+		{
+			name:     "model can't be queried",
+			provider: failingProvider{},
+			body:     `{"hint": "a macvlan for my database pods"}`,
+			want:     http.StatusBadGateway,
+		},
+		{
+			name: "free-form hint without an LLM",
+			body: `{"hint": "a macvlan for my database pods"}`,
+			want: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, err := apiHandler(testSettings, testOptions(tt.provider), newLLMProvider)
+			if err != nil {
+				t.Fatalf("apiHandler() error: %v", err)
+			}
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			method := tt.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			request, err := http.NewRequest(method, server.URL+"/v1/generate", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatalf("POST /v1/generate error: %v", err)
+			}
+			defer resp.Body.Close()
+
+			var response GenerateResponse
+			if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+				t.Fatalf("error parsing the response: %v", err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Fatalf("POST /v1/generate = %d, want %d: %s", resp.StatusCode, tt.want, response.Error)
+			}
+
+			switch {
+			case tt.want == http.StatusOK:
+				if len(response.Config) == 0 || response.NetAttachDef == "" || response.Validation == nil || !response.Validation.Valid {
+					t.Errorf("POST /v1/generate = %+v, want a valid config", response)
+				}
+			case response.Error == "":
+				t.Errorf("POST /v1/generate has no error")
+			}
+			if tt.wantFields != nil {
+				var fields []string
+				for _, err := range response.Validation.Errors {
+					fields = append(fields, err.Field)
+				}
+				if strings.Join(fields, ",") != strings.Join(tt.wantFields, ",") {
+					t.Errorf("POST /v1/generate validation errors on %v, want %v", fields, tt.wantFields)
+				}
+			}
+		})
+	}
+}
+
+func TestAPIHandlerTooManyRequests(t *testing.T) {
+	provider := blockingProvider{called: make(chan struct{}), release: make(chan struct{})}
+	handler, err := apiHandler(testSettings, testOptions(provider), newLLMProvider)
+	if err != nil {
+		t.Fatalf("apiHandler() error: %v", err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	body := `{"hint": "a macvlan for my database pods"}`
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := http.Post(server.URL+"/v1/generate", "application/json", strings.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-provider.called
+
+	resp, err := http.Post(server.URL+"/v1/generate", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST /v1/generate error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("POST /v1/generate while busy = %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+
+	close(provider.release)
+	<-done
+}
+
+func TestAPIHandlerSettings(t *testing.T) {
+	for _, settings := range []ServerSettings{
+		{MaxConcurrent: 0, MaxAttempts: 1, MaxCandidates: 1},
+		{MaxConcurrent: 1, MaxAttempts: 0, MaxCandidates: 1},
+		{MaxConcurrent: 1, MaxAttempts: 1, MaxCandidates: 0},
+	} {
+		if _, err := apiHandler(settings, testOptions(nil), newLLMProvider); err == nil {
+			t.Errorf("apiHandler(%+v) gave no error", settings)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// streamProgress shows the model's replies on stderr as they stream in: the
+// raw tokens when debugging, otherwise a running count of them. When voting,
+// each line of raw tokens starts with the candidate it's from, since
+// candidates generated in parallel stream in at the same time.
+type streamProgress struct {
+	mu     sync.Mutex
+	debug  bool
+	tokens int
+	// inLine is set while the progress line hasn't been ended, and candidate
+	// is the one the line is for.
+	inLine    bool
+	candidate int
+}
+
+func (p *streamProgress) Token(candidate int, token string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tokens++
+	if !p.debug {
+		fmt.Fprintf(os.Stderr, "\rReceiving the reply... %d tokens", p.tokens)
+		p.inLine = true
+		return
+	}
+	if candidate == 0 {
+		fmt.Fprint(os.Stderr, token)
+		p.inLine = !strings.HasSuffix(token, "\n")
+		return
+	}
+
+	for _, line := range strings.SplitAfter(token, "\n") {
+		if line == "" {
+			continue
+		}
+		if p.inLine && p.candidate != candidate {
+			fmt.Fprintln(os.Stderr)
+			p.inLine = false
+		}
+		if !p.inLine {
+			fmt.Fprintf(os.Stderr, "Candidate %d: ", candidate)
+		}
+		fmt.Fprint(os.Stderr, line)
+		p.inLine = !strings.HasSuffix(line, "\n")
+		p.candidate = candidate
+	}
+}
+
+// Log ends the progress line before logging the message, so the next reply
+// starts on a fresh line.
+func (p *streamProgress) Log(message string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.inLine {
+		fmt.Fprintln(os.Stderr)
+		p.inLine = false
+	}
+	p.tokens = 0
+	logErr(message)
+}
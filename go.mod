@@ -1,3 +1,13 @@
 module github.com/dougbtv/robocniconfig
 
 go 1.20
+
+require (
+	github.com/vishvananda/netlink v1.3.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/vishvananda/netns v0.0.4 // indirect
+	golang.org/x/sys v0.10.0 // indirect
+)
@@ -21,7 +21,7 @@ mkdir -p bin
 
 # Build the robocni binary
 echo "Building $ROBOCNI..."
-go build -o bin/$ROBOCNI ./cmd/robocni/$ROBOCNI.go
+go build -o bin/$ROBOCNI ./cmd/robocni
 
 # Check if build was successful
 if [ $? -ne 0 ]; then
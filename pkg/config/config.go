@@ -0,0 +1,147 @@
+// Package config loads the robocni config file, which holds named profiles
+// of defaults shared by robocni and looprobocni.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Profile is a named set of defaults. Any flag given on the command line
+// overrides the profile.
+type Profile struct {
+	Provider string `yaml:"provider,omitempty"`
+	Host     string `yaml:"host,omitempty"`
+	Port     string `yaml:"port,omitempty"`
+	Endpoint string `yaml:"endpoint,omitempty"`
+	APIKey   string `yaml:"apiKey,omitempty"`
+	Model    string `yaml:"model,omitempty"`
+	// ConnectTimeout and Timeout are durations, like 10s, for connecting to
+	// the LLM service and for a whole query.
+	ConnectTimeout string `yaml:"connectTimeout,omitempty"`
+	Timeout        string `yaml:"timeout,omitempty"`
+	// Options are passed to the model as generation options, like temperature.
+	Options map[string]interface{} `yaml:"options,omitempty"`
+	// PromptTemplate is the path of a template replacing the built in system prompt.
+	PromptTemplate string `yaml:"promptTemplate,omitempty"`
+	// TemplateDir holds templates and examples overriding the built in ones.
+	TemplateDir string `yaml:"templateDir,omitempty"`
+	// ExampleSelection and EmbedModel choose the examples shown to the model.
+	ExampleSelection string            `yaml:"exampleSelection,omitempty"`
+	EmbedModel       string            `yaml:"embedModel,omitempty"`
+	Namespace        string            `yaml:"namespace,omitempty"`
+	Labels           map[string]string `yaml:"labels,omitempty"`
+	Annotations      map[string]string `yaml:"annotations,omitempty"`
+}
+
+// Config is the contents of the config file.
+type Config struct {
+	// DefaultProfile is used when no -profile is given.
+	DefaultProfile string             `yaml:"defaultProfile,omitempty"`
+	Profiles       map[string]Profile `yaml:"profiles,omitempty"`
+}
+
+// DefaultPath is where the config file lives unless -config says otherwise,
+// usually ~/.config/robocni/config.yaml.
+func DefaultPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "robocni", "config.yaml")
+}
+
+// Load reads the config file at path. A missing file is only an error when
+// the path was asked for explicitly, rather than being the default path.
+func Load(path string) (*Config, error) {
+	explicit := path != ""
+	if !explicit {
+		path = DefaultPath()
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) && !explicit {
+			return &Config{}, nil
+		}
+		return nil, fmt.Errorf("error reading config file %s: %v", path, err)
+	}
+
+	config := &Config{}
+	if err := yaml.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// Profile returns the named profile, or the default profile when name is
+// empty. Without a config file, that is an empty profile.
+func (c *Config) Profile(name string) (Profile, error) {
+	if name == "" {
+		name = c.DefaultProfile
+		if name == "" {
+			// A profile called "default" is used if there is one.
+			return c.Profiles["default"], nil
+		}
+	}
+
+	profile, ok := c.Profiles[name]
+	if !ok {
+		var names []string
+		for n := range c.Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return Profile{}, fmt.Errorf("no profile named %q in the config file, found: %s", name, strings.Join(names, ", "))
+	}
+	return profile, nil
+}
+
+// FlagValues maps the names of the command line flags to the profile's values.
+func (p Profile) FlagValues() map[string]string {
+	return map[string]string{
+		"provider":          p.Provider,
+		"host":              p.Host,
+		"port":              p.Port,
+		"endpoint":          p.Endpoint,
+		"apikey":            p.APIKey,
+		"model":             p.Model,
+		"connect-timeout":   p.ConnectTimeout,
+		"timeout":           p.Timeout,
+		"prompt-template":   p.PromptTemplate,
+		"template-dir":      p.TemplateDir,
+		"example-selection": p.ExampleSelection,
+		"embed-model":       p.EmbedModel,
+		"namespace":         p.Namespace,
+	}
+}
+
+// SetFlags returns the names of the flags given on the command line.
+func SetFlags(fs *flag.FlagSet) map[string]bool {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+// Apply sets every flag of fs that is defined, wasn't given on the command
+// line and has a non-empty value in values.
+func Apply(fs *flag.FlagSet, set map[string]bool, values map[string]string) error {
+	for name, value := range values {
+		if value == "" || set[name] || fs.Lookup(name) == nil {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("invalid %s in profile: %v", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package robocni
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ResponseCache keeps validated configs on disk, so the same hint with the
+// same model, options and prompt doesn't query the model again.
+type ResponseCache struct {
+	Dir string
+}
+
+// CacheEntry is a cached config.
+type CacheEntry struct {
+	Hint       string    `json:"hint"`
+	Model      string    `json:"model"`
+	Config     string    `json:"config"`
+	Confidence float64   `json:"confidence,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// DefaultCacheDir is where responses are cached unless -cache-dir says otherwise.
+func DefaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "robocni", "responses")
+}
+
+// normalizeHint ignores case and spacing, which don't change the meaning of a hint.
+func normalizeHint(hint string) string {
+	return strings.Join(strings.Fields(strings.ToLower(hint)), " ")
+}
+
+// cacheKey hashes everything that affects the answer: the normalised hint,
+// the provider, model and options, and the prompt around the hint, which
+// covers the templates, examples and host data.
+func cacheKey(hint string, provider LLMProvider, model string, request ChatRequest, candidates int) string {
+	prompt := sha256.New()
+	for _, message := range request.Messages {
+		fmt.Fprintf(prompt, "%s\x00%s\x00", message.Role, strings.ReplaceAll(message.Content, hint, ""))
+	}
+	prompt.Write(request.Format)
+
+	key := sha256.New()
+	fmt.Fprintf(key, "%s\x00%s\x00%s\x00%s\x00%d\x00%x",
+		normalizeHint(hint), provider.Name(), model, formatOptions(request.Options), candidates, prompt.Sum(nil))
+	return hex.EncodeToString(key.Sum(nil))
+}
+
+func (c ResponseCache) path(key string) string {
+	return filepath.Join(c.Dir, key+".json")
+}
+
+// Get returns the cached entry for key, or nil if there isn't one.
+func (c ResponseCache) Get(key string) (*CacheEntry, error) {
+	content, err := os.ReadFile(c.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading the cache: %v", err)
+	}
+
+	entry := &CacheEntry{}
+	if err := json.Unmarshal(content, entry); err != nil {
+		return nil, fmt.Errorf("error parsing cache entry %s: %v", c.path(key), err)
+	}
+	return entry, nil
+}
+
+// Put stores the entry under key.
+func (c ResponseCache) Put(key string, entry CacheEntry) error {
+	content, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling cache entry: %v", err)
+	}
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return fmt.Errorf("error creating the cache directory: %v", err)
+	}
+	if err := os.WriteFile(c.path(key), content, 0644); err != nil {
+		return fmt.Errorf("error writing the cache: %v", err)
+	}
+	return nil
+}
+
+// Prune removes the entries older than maxAge, or every entry when maxAge is
+// zero, and returns how many it removed.
+func (c ResponseCache) Prune(maxAge time.Duration) (int, error) {
+	matches, err := filepath.Glob(filepath.Join(c.Dir, "*.json"))
+	if err != nil {
+		return 0, fmt.Errorf("error reading the cache: %v", err)
+	}
+
+	removed := 0
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil {
+			return removed, fmt.Errorf("error reading the cache: %v", err)
+		}
+		if maxAge > 0 && time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		if err := os.Remove(match); err != nil {
+			return removed, fmt.Errorf("error pruning the cache: %v", err)
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,156 @@
+package robocni
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// namedProvider is a provider that is only used for its name.
+type namedProvider string
+
+func (p namedProvider) Name() string         { return string(p) }
+func (p namedProvider) SupportsFormat() bool { return true }
+
+func (p namedProvider) Chat(ctx context.Context, request ChatRequest) (string, error) {
+	return "", errors.New("not a real provider")
+}
+
+// hintRequest is a conversation around the hint, like buildConversation's.
+func hintRequest(system string, hint string) ChatRequest {
+	return ChatRequest{
+		Messages: []ChatMessage{
+			{Role: "system", Content: system},
+			{Role: "user", Content: "Now create a CNI configuration given this hint: " + hint},
+		},
+		Format:  json.RawMessage(`"json"`),
+		Options: map[string]interface{}{"temperature": 0.2},
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	const hint = "macvlan on eth0 with whereabouts 10.40.0.0/24"
+	base := cacheKey(hint, namedProvider("ollama"), "llama2:13b", hintRequest("You write CNI configs.", hint), 1)
+
+	tests := []struct {
+		name       string
+		hint       string
+		provider   string
+		model      string
+		request    func(hint string) ChatRequest
+		candidates int
+		same       bool
+	}{
+		{
+			name: "same request",
+			same: true,
+		},
+		{
+			name: "hint with other case and spacing",
+			hint: "  Macvlan on ETH0  with whereabouts 10.40.0.0/24",
+			same: true,
+		},
+		{
+			name: "other hint",
+			hint: "macvlan on eth1 with whereabouts 10.40.0.0/24",
+		},
+		{
+			name:     "other provider",
+			provider: "openai",
+		},
+		{
+			name:  "other model",
+			model: "llama3",
+		},
+		{
+			name:       "more candidates",
+			candidates: 3,
+		},
+		{
+			name:    "other system prompt",
+			request: func(hint string) ChatRequest { return hintRequest("You write CNI conflists.", hint) },
+		},
+		{
+			name: "other options",
+			request: func(hint string) ChatRequest {
+				request := hintRequest("You write CNI configs.", hint)
+				request.Options = map[string]interface{}{"temperature": 0.2, "seed": 42}
+				return request
+			},
+		},
+		{
+			name: "other format",
+			request: func(hint string) ChatRequest {
+				request := hintRequest("You write CNI configs.", hint)
+				request.Format = nil
+				return request
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hint, provider, model, candidates := hint, "ollama", "llama2:13b", 1
+			if tt.hint != "" {
+				hint = tt.hint
+			}
+			if tt.provider != "" {
+				provider = tt.provider
+			}
+			if tt.model != "" {
+				model = tt.model
+			}
+			if tt.candidates != 0 {
+				candidates = tt.candidates
+			}
+			request := hintRequest("You write CNI configs.", hint)
+			if tt.request != nil {
+				request = tt.request(hint)
+			}
+
+			key := cacheKey(hint, namedProvider(provider), model, request, candidates)
+			if (key == base) != tt.same {
+				t.Errorf("cacheKey() = %s, the same as the base key: %v, want %v", key, key == base, tt.same)
+			}
+		})
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	cache := ResponseCache{Dir: filepath.Join(t.TempDir(), "responses")}
+
+	entry, err := cache.Get("missing")
+	if err != nil || entry != nil {
+		t.Fatalf("Get() of a missing key = %v, %v, want nothing", entry, err)
+	}
+
+	want := CacheEntry{Hint: "macvlan on eth0", Model: "llama2:13b", Config: `{"name": "mv"}`, CreatedAt: time.Now().UTC().Truncate(time.Second)}
+	if err := cache.Put("new", want); err != nil {
+		t.Fatalf("Put() error: %v", err)
+	}
+	if err := cache.Put("old", want); err != nil {
+		t.Fatalf("Put() error: %v", err)
+	}
+	entry, err = cache.Get("new")
+	if err != nil || entry == nil || *entry != want {
+		t.Fatalf("Get() = %v, %v, want %v", entry, err, want)
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(cache.path("old"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := cache.Prune(24 * time.Hour); err != nil || removed != 1 {
+		t.Errorf("Prune(24h) = %d, %v, want 1 removed", removed, err)
+	}
+	if entry, _ := cache.Get("old"); entry != nil {
+		t.Errorf("Prune(24h) kept the old entry")
+	}
+	if removed, err := cache.Prune(0); err != nil || removed != 1 {
+		t.Errorf("Prune(0) = %d, %v, want 1 removed", removed, err)
+	}
+}
@@ -0,0 +1,245 @@
+package robocni
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// exampleTypes returns the plugin types of an example's configuration, the
+// main plugin first, and its IPAM type (ipamNone when it has no IPAM).
+func exampleTypes(example Example) ([]string, string) {
+	var conf map[string]interface{}
+	if err := json.Unmarshal([]byte(example.Config), &conf); err != nil {
+		return nil, ""
+	}
+
+	var types []string
+	plugins, _ := pluginsOf(conf)
+	for _, plugin := range plugins {
+		if t, ok := plugin["type"].(string); ok {
+			types = append(types, t)
+		}
+	}
+
+	ipamType := ipamNone
+	if len(plugins) > 0 {
+		ipam, _ := plugins[0]["ipam"].(map[string]interface{})
+		if t, ok := ipam["type"].(string); ok {
+			ipamType = t
+		}
+	}
+	return types, ipamType
+}
+
+// keywordScore rates how relevant an example is to the hint, by comparing
+// the plugins and IPAM the hint asks for with the ones the example uses.
+// Examples of another plugin type score zero.
+func keywordScore(example Example, hint HintConstraints) int {
+	types, ipamType := exampleTypes(example)
+	if len(types) == 0 {
+		return 0
+	}
+
+	score := 0
+	if hint.PluginType != "" {
+		if types[0] != hint.PluginType {
+			return 0
+		}
+		score += 4
+	}
+	for _, chained := range types[1:] {
+		// Chains the hint didn't ask for make an example less relevant.
+		if contains(hint.Chained, chained) {
+			score += 2
+		} else {
+			score--
+		}
+	}
+	if hint.IPAMType != "" && hint.IPAMType == ipamType {
+		score += 2
+	}
+	return score
+}
+
+// selectExamplesByKeyword keeps the examples that use the plugins and IPAM
+// named in the hint, best match first, up to max of them (0 for no limit).
+// When there is no example of the plugin, the ones using the same IPAM or
+// chained plugins are kept instead, and when nothing matches at all, none.
+// Only a hint that names none of these gets the first examples, so the
+// model still sees what a configuration looks like.
+func selectExamplesByKeyword(examples []Example, hint HintConstraints, max int) []Example {
+	if hint.PluginType == "" && hint.IPAMType == "" && len(hint.Chained) == 0 {
+		return limitExamples(examples, max)
+	}
+
+	selected, scores := scoreExamples(examples, hint)
+	if len(selected) == 0 && hint.PluginType != "" {
+		withoutPlugin := hint
+		withoutPlugin.PluginType = ""
+		selected, scores = scoreExamples(examples, withoutPlugin)
+	}
+
+	sort.SliceStable(selected, func(i, j int) bool {
+		return scores[selected[i].Name] > scores[selected[j].Name]
+	})
+	return limitExamples(selected, max)
+}
+
+// scoreExamples returns the examples relevant to the hint, with their scores.
+func scoreExamples(examples []Example, hint HintConstraints) ([]Example, map[string]int) {
+	var selected []Example
+	scores := map[string]int{}
+	for _, example := range examples {
+		if score := keywordScore(example, hint); score > 0 {
+			scores[example.Name] = score
+			selected = append(selected, example)
+		}
+	}
+	return selected, scores
+}
+
+// selectExamplesByEmbedding keeps the examples whose hints are the most
+// similar to the user's hint, according to the embedding model.
+func (g *Generator) selectExamplesByEmbedding(ctx context.Context, examples []Example, hint string, embedder Embedder, model string, max int) ([]Example, error) {
+	store, err := loadEmbeddingStore(model)
+	if err != nil {
+		return nil, err
+	}
+
+	hintVector, err := embedder.Embed(ctx, model, hint)
+	if err != nil {
+		return nil, fmt.Errorf("error embedding the hint: %v", err)
+	}
+
+	similarity := map[string]float64{}
+	for _, example := range examples {
+		vector, err := store.vector(ctx, example, embedder)
+		if err != nil {
+			return nil, fmt.Errorf("error embedding example %s: %v", example.Name, err)
+		}
+		similarity[example.Name] = cosineSimilarity(hintVector, vector)
+	}
+	if err := store.save(); err != nil {
+		// The store only saves time, so carry on without it.
+		g.log(fmt.Sprintf("Could not save the example embeddings: %v", err))
+	}
+
+	selected := append([]Example{}, examples...)
+	sort.SliceStable(selected, func(i, j int) bool {
+		return similarity[selected[i].Name] > similarity[selected[j].Name]
+	})
+	return limitExamples(selected, max), nil
+}
+
+// selectExamples picks the few-shot examples for the hint, using the
+// ExampleSelection mode: keyword, embedding or all.
+func (g *Generator) selectExamples(ctx context.Context, examples []Example, hint HintConstraints) ([]Example, error) {
+	mode, provider, max := g.opts.ExampleSelection, g.opts.Provider, g.opts.MaxExamples
+	switch mode {
+	case "all":
+		return examples, nil
+	case "keyword":
+		return selectExamplesByKeyword(examples, hint, max), nil
+	case "embedding":
+		embedder, ok := provider.(Embedder)
+		if !ok {
+			return nil, fmt.Errorf("the %s provider can't compute embeddings, use -example-selection keyword", provider.Name())
+		}
+		return g.selectExamplesByEmbedding(ctx, examples, hint.Hint, embedder, g.opts.EmbedModel, max)
+	}
+	return nil, fmt.Errorf("unknown example selection %q, must be one of: keyword, embedding, all", mode)
+}
+
+func limitExamples(examples []Example, max int) []Example {
+	if max > 0 && len(examples) > max {
+		return examples[:max]
+	}
+	return examples
+}
+
+func cosineSimilarity(a, b []float64) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+// embeddingStore keeps the embeddings of the examples on disk, keyed by a
+// hash of the example, so they are only computed once per embedding model.
+type embeddingStore struct {
+	model   string
+	path    string
+	vectors map[string][]float64
+	changed bool
+}
+
+func loadEmbeddingStore(model string) (*embeddingStore, error) {
+	store := &embeddingStore{model: model, vectors: map[string][]float64{}}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		// Without a cache directory, the embeddings are computed every time.
+		return store, nil
+	}
+	store.path = filepath.Join(dir, "robocni", "embeddings", strings.NewReplacer("/", "_", ":", "_").Replace(model)+".json")
+
+	content, err := os.ReadFile(store.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading example embeddings: %v", err)
+	}
+	if err := json.Unmarshal(content, &store.vectors); err != nil {
+		return nil, fmt.Errorf("error parsing example embeddings %s: %v", store.path, err)
+	}
+	return store, nil
+}
+
+// vector returns the embedding of the example's hint, computing it if needed.
+func (s *embeddingStore) vector(ctx context.Context, example Example, embedder Embedder) ([]float64, error) {
+	sum := sha256.Sum256([]byte(example.Hint + "\n" + example.Config))
+	key := hex.EncodeToString(sum[:])
+	if vector, ok := s.vectors[key]; ok {
+		return vector, nil
+	}
+
+	vector, err := embedder.Embed(ctx, s.model, example.Hint)
+	if err != nil {
+		return nil, err
+	}
+	s.vectors[key] = vector
+	s.changed = true
+	return vector, nil
+}
+
+func (s *embeddingStore) save() error {
+	if !s.changed || s.path == "" {
+		return nil
+	}
+	content, err := json.Marshal(s.vectors)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, content, 0644)
+}
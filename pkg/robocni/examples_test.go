@@ -0,0 +1,98 @@
+package robocni
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestSelectExamplesByKeyword(t *testing.T) {
+	examples, err := Templates{}.Examples()
+	if err != nil {
+		t.Fatalf("error reading the built in examples: %v", err)
+	}
+
+	tests := []struct {
+		hint string
+		want []string
+	}{
+		{
+			hint: "macvlan on eth0 with whereabouts 10.40.0.0/24",
+			want: []string{"macvlan-whereabouts", "macvlan-tuning-bandwidth", "macvlan"},
+		},
+		{
+			hint: "ipvlan on eth0 with dhcp",
+			want: []string{"ipvlan"},
+		},
+		{
+			// There is no vlan example, so the ones using host-local do.
+			hint: "vlan 100 on eth0 with host-local 10.10.0.0/16",
+			want: []string{"bridge", "ipvlan"},
+		},
+		{
+			hint: "ptp with tuning",
+			want: []string{"macvlan-tuning-bandwidth"},
+		},
+		{
+			hint: "ptp with dhcp",
+			want: []string{"macvlan"},
+		},
+		{
+			hint: "ptp on 10.10.0.0/16",
+		},
+		{
+			hint: "a network for my database pods",
+			want: []string{"bridge-l2", "bridge", "host-device"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.hint, func(t *testing.T) {
+			var names []string
+			for _, example := range selectExamplesByKeyword(examples, analyzeHint(tt.hint), 3) {
+				names = append(names, example.Name)
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("selectExamplesByKeyword(%q) = %v, want %v", tt.hint, names, tt.want)
+			}
+		})
+	}
+}
+
+// The examples must follow the naming rule the model is given.
+func TestExampleNamesMatchSchema(t *testing.T) {
+	templates := Templates{}
+	content, err := templates.Read("cni_schema.json")
+	if err != nil {
+		t.Fatalf("error reading the CNI schema: %v", err)
+	}
+	var schema struct {
+		Properties struct {
+			Name struct {
+				Pattern string `json:"pattern"`
+			} `json:"name"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal(content, &schema); err != nil {
+		t.Fatalf("error parsing the CNI schema: %v", err)
+	}
+	pattern := regexp.MustCompile(schema.Properties.Name.Pattern)
+
+	examples, err := templates.Examples()
+	if err != nil {
+		t.Fatalf("error reading the built in examples: %v", err)
+	}
+	for _, example := range examples {
+		var conf struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal([]byte(example.Config), &conf); err != nil {
+			t.Errorf("example %s is not valid JSON: %v", example.Name, err)
+			continue
+		}
+		if !pattern.MatchString(conf.Name) {
+			t.Errorf("example %s is named %q, which doesn't match %s", example.Name, conf.Name, pattern)
+		}
+	}
+}
@@ -0,0 +1,490 @@
+// Package robocni generates CNI configurations and net-attach-defs from
+// hints, using rules for structured hints and an LLM for the rest.
+package robocni
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Defaults used for the zero values of Options.
+const (
+	DefaultAttempts   = 5
+	DefaultRetries    = 3
+	DefaultEmbedModel = "nomic-embed-text"
+)
+
+// ErrNeedsLLM is returned for hints the rules can't handle, when there is no
+// LLM provider to ask.
+var ErrNeedsLLM = errors.New("the hint needs an LLM, please set --host, --endpoint, the OLLAMA_HOST environment variable or a host in the config profile")
+
+// Options are the settings of a Generator. The zero values of the modes and
+// numbers are sensible defaults, except for Retries, where zero means no
+// retries. The bools are off unless set, so unlike the robocni command, which
+// fixes the master by default, a Generator needs FixMaster set to do so.
+type Options struct {
+	// Generator is auto (rules for structured hints, otherwise the LLM),
+	// rules or llm.
+	Generator string
+	// Provider is the LLM to query, it may be nil when only using rules.
+	Provider LLMProvider
+	// Model is the provider's model, recorded on the net-attach-def.
+	Model string
+
+	// Host is the host's networking, RawInterfaces and RawRoutes are dumps
+	// given to the model as is, when they couldn't be parsed.
+	Host          *HostNetwork
+	RawInterfaces string
+	RawRoutes     string
+	// FixMaster replaces a master that isn't usable on the host, instead of
+	// rejecting the config.
+	FixMaster bool
+
+	// Format is schema (the default), json or none.
+	Format    string
+	Templates Templates
+	// ExampleSelection is keyword (the default), embedding or all.
+	ExampleSelection string
+	EmbedModel       string
+	// MaxExamples limits the examples in the prompt, 0 for no limit.
+	MaxExamples int
+	// Options are generation options using Ollama's names, like temperature.
+	Options     map[string]interface{}
+	MaxAttempts int
+	// Retries is how many times a query that couldn't reach the provider is
+	// retried, backing off exponentially, before giving up. Unlike attempts,
+	// these are for network trouble rather than bad answers. Zero disables
+	// retries, robocni uses DefaultRetries.
+	Retries int
+	// Candidates to vote on, and how many of them to generate at a time.
+	Candidates int
+	Parallel   int
+
+	// Cache is nil when caching is off.
+	Cache        *ResponseCache
+	RefreshCache bool
+
+	Namespace    string
+	Labels       map[string]string
+	Annotations  map[string]string
+	NoProvenance bool
+	Compact      bool
+
+	// Log receives progress messages, like the outcome of each attempt.
+	Log func(message string)
+	// Stream, when set, is called with each piece of the model's replies as
+	// it arrives, and the candidate it is for when voting, or 0. A reply is
+	// cut short once it holds a complete JSON object or fenced JSON block,
+	// since nothing after it is used.
+	Stream func(candidate int, token string)
+	Debug  bool
+}
+
+// Result is a generated config and how it came about.
+type Result struct {
+	Config       string
+	Name         string
+	NetAttachDef *NetworkAttachmentDefinition
+	// GeneratedBy is the provider name, or "rules".
+	GeneratedBy string
+	Examples    []string
+	Attempts    []Attempt
+	// Corrections made to the config, like replacing the master.
+	Corrections []string
+	// Confidence is the share of candidates agreeing on the config, and
+	// Candidate the one it was taken from, when voting.
+	Confidence float64
+	Candidate  int
+	CacheHit   bool
+}
+
+// Attempt records the outcome of a single query to the model.
+type Attempt struct {
+	// Candidate is the candidate the attempt was for, when voting.
+	Candidate int
+	Number    int
+	// Prompt is the conversation sent to the model, which grows with the
+	// rejected answers of the previous attempts.
+	Prompt   []ChatMessage
+	Response string
+	Err      error
+	// Corrections made to the config, when the attempt succeeded.
+	Corrections []string
+}
+
+// SucceededAttempt returns the attempt that gave the config, or nil when the
+// config came from the rules or the cache.
+func (r *Result) SucceededAttempt() *Attempt {
+	for i := range r.Attempts {
+		if r.Attempts[i].Err == nil && r.Attempts[i].Candidate == r.Candidate {
+			return &r.Attempts[i]
+		}
+	}
+	return nil
+}
+
+// GenerationError is returned when no attempt gave a valid config. It
+// unwraps to the error of the last attempt, which may be ValidationErrors.
+type GenerationError struct {
+	Attempts   []Attempt
+	Candidates int
+}
+
+func (e *GenerationError) Error() string {
+	// The model wasn't at fault when it couldn't be queried.
+	var queryErr *QueryError
+	if errors.As(e.Unwrap(), &queryErr) {
+		return queryErr.Error()
+	}
+	if e.Candidates > 1 {
+		return fmt.Sprintf("all %d candidates failed", e.Candidates)
+	}
+	return fmt.Sprintf("LLM Query failed in %d tries :( #failburger", len(e.Attempts))
+}
+
+func (e *GenerationError) Unwrap() error {
+	if len(e.Attempts) == 0 {
+		return nil
+	}
+	return e.Attempts[len(e.Attempts)-1].Err
+}
+
+// Generator turns hints into CNI configs and net-attach-defs.
+type Generator struct {
+	opts Options
+}
+
+// NewGenerator checks the options and fills in the defaults.
+func NewGenerator(opts Options) (*Generator, error) {
+	if opts.MaxAttempts < 0 || opts.Retries < 0 || opts.Candidates < 0 || opts.Parallel < 0 || opts.MaxExamples < 0 {
+		return nil, errors.New("the numbers of attempts, retries, candidates and examples can't be negative")
+	}
+	if opts.MaxAttempts == 0 {
+		opts.MaxAttempts = DefaultAttempts
+	}
+	if opts.Candidates == 0 {
+		opts.Candidates = 1
+	}
+	if opts.Parallel == 0 {
+		opts.Parallel = 1
+	}
+	if opts.Generator == "" {
+		opts.Generator = "auto"
+	}
+	if opts.Format == "" {
+		opts.Format = "schema"
+	}
+	if opts.ExampleSelection == "" {
+		opts.ExampleSelection = "keyword"
+	}
+	if opts.EmbedModel == "" {
+		opts.EmbedModel = DefaultEmbedModel
+	}
+	if !contains(generatorModes, opts.Generator) {
+		return nil, fmt.Errorf("unknown generator %q, must be one of: %s", opts.Generator, strings.Join(generatorModes, ", "))
+	}
+	if !contains(outputFormats, opts.Format) {
+		return nil, fmt.Errorf("unknown format %q, must be one of: %s", opts.Format, strings.Join(outputFormats, ", "))
+	}
+	if opts.Namespace != "" && !ValidNamespace(opts.Namespace) {
+		return nil, fmt.Errorf("the namespace %q is not a valid DNS-1123 name", opts.Namespace)
+	}
+	if opts.Host == nil {
+		opts.Host = &HostNetwork{}
+	}
+	return &Generator{opts: opts}, nil
+}
+
+// Options returns the generator's options, with the defaults filled in.
+func (g *Generator) Options() Options {
+	return g.opts
+}
+
+func (g *Generator) log(message string) {
+	if g.opts.Log != nil {
+		g.opts.Log(message)
+	}
+}
+
+// Generate turns the hint into a validated CNI config and net-attach-def,
+// using the rules or the LLM. The result holds the attempts made even when
+// generation fails. Cancelling ctx stops any query to the LLM.
+func (g *Generator) Generate(ctx context.Context, hint string) (*Result, error) {
+	opts := g.opts
+	result := &Result{}
+
+	useRules, err := useRuleGenerator(opts.Generator, hint)
+	if err != nil {
+		return result, err
+	}
+	if !useRules && opts.Provider == nil {
+		return result, ErrNeedsLLM
+	}
+
+	// Leave out loopback, veths and the like, the LLM shouldn't use them.
+	validator := Validator{Host: opts.Host, FixMaster: opts.FixMaster}
+	host := opts.Host.Filtered()
+	defaultInterface := host.DefaultInterface()
+	ifs, routes := opts.RawInterfaces, opts.RawRoutes
+	if ifs == "" {
+		ifs = host.InterfacesSummary()
+	}
+	if routes == "" {
+		routes = host.RoutesSummary()
+	}
+	if opts.Debug && (ifs != "" || routes != "") {
+		g.log("Interfaces:\n" + ifs)
+		g.log("Routes:\n" + routes)
+		g.log("Default route interface: " + defaultInterface)
+	}
+
+	constraints := analyzeHint(hint)
+	// Without the interfaces the default route interface can't be checked.
+	if len(validator.Host.Interfaces) == 0 || validator.Host.masterProblem(defaultInterface) == "" {
+		constraints.DefaultMaster = defaultInterface
+	}
+	if opts.Debug {
+		g.log(fmt.Sprintf("Constraints found in the hint: %v", constraints))
+	}
+	if constraints.Master != "" && len(validator.Host.Interfaces) > 0 {
+		if problem := validator.Host.masterProblem(constraints.Master); problem != "" {
+			g.log(fmt.Sprintf("Warning: the hint asks for master %s, but %s", constraints.Master, problem))
+		}
+	}
+	validator.Hint = constraints
+
+	options := opts.Options
+	if useRules {
+		result.GeneratedBy, options = "rules", nil
+		result.Config, result.Name, result.Corrections, err = g.generateFromRules(validator)
+		if err != nil {
+			return result, err
+		}
+	} else {
+		result.GeneratedBy = opts.Provider.Name()
+		if err := g.generateWithLLM(ctx, validator, QueryTemplateData{
+			Interfaces: ifs,
+			Routes:     routes,
+			Hint:       hint,
+
+			DefaultInterface: defaultInterface,
+		}, result); err != nil {
+			return result, err
+		}
+	}
+
+	meta := NetworkAttachmentDefinitionMeta{
+		Name:      result.Name,
+		Namespace: opts.Namespace,
+	}
+	if meta.Namespace == "" {
+		meta.Namespace = constraints.Namespace
+	}
+	if len(opts.Labels) > 0 {
+		meta.Labels = opts.Labels
+	}
+	if !opts.NoProvenance {
+		model := opts.Model
+		if useRules {
+			model = ""
+		}
+		meta.Annotations = provenanceAnnotations(hint, model, result.GeneratedBy, time.Now())
+		if len(options) > 0 {
+			meta.Annotations[AnnotationPrefix+"options"] = formatOptions(options)
+		}
+		if result.Confidence != 0 {
+			meta.Annotations[AnnotationPrefix+"confidence"] = fmt.Sprintf("%.2f", result.Confidence)
+		}
+	}
+	for k, v := range opts.Annotations {
+		if meta.Annotations == nil {
+			meta.Annotations = map[string]string{}
+		}
+		meta.Annotations[k] = v
+	}
+
+	result.NetAttachDef, err = newNetAttachDef(meta, result.Config, opts.Compact)
+	if err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// generateWithLLM builds the prompt and queries the model, or the cache,
+// filling in the result.
+func (g *Generator) generateWithLLM(ctx context.Context, validator Validator, data QueryTemplateData, result *Result) error {
+	opts := g.opts
+	provider := opts.Provider
+	format, err := outputFormat(opts.Templates, opts.Format)
+	if err != nil {
+		return err
+	}
+	if format != nil && !provider.SupportsFormat() {
+		if opts.Debug {
+			g.log(fmt.Sprintf("The %s provider can't constrain output, falling back to backtick-enclosed JSON", provider.Name()))
+		}
+		format = nil
+	}
+	data.Fenced = format == nil
+
+	examples, err := opts.Templates.Examples()
+	if err != nil {
+		return fmt.Errorf("error building the prompt: %v", err)
+	}
+	examples, err = g.selectExamples(ctx, examples, validator.Hint)
+	if err != nil {
+		return fmt.Errorf("error selecting examples: %v", err)
+	}
+	for _, example := range examples {
+		result.Examples = append(result.Examples, example.Name)
+	}
+	if len(result.Examples) == 0 {
+		g.log("Using no examples, none match the hint")
+	} else {
+		g.log(fmt.Sprintf("Using examples: %s", strings.Join(result.Examples, ", ")))
+	}
+
+	messages, err := buildConversation(opts.Templates, data, examples)
+	if err != nil {
+		return fmt.Errorf("error building the prompt: %v", err)
+	}
+	request := ChatRequest{Messages: messages, Format: format, Options: opts.Options}
+	if opts.Debug && len(opts.Options) > 0 {
+		g.log("Generation options: " + formatOptions(opts.Options))
+	}
+
+	key := cacheKey(data.Hint, provider, opts.Model, request, opts.Candidates)
+	if opts.Cache != nil && !opts.RefreshCache {
+		cached, err := opts.Cache.Get(key)
+		if err != nil {
+			g.log(fmt.Sprintf("Ignoring the response cache: %v", err))
+		}
+		if cached != nil {
+			// Cached configs are checked again, in case the validation changed.
+			result.Config, result.Name, result.Corrections, err = parseAndValidateJSON(cached.Config, validator)
+			if err == nil {
+				result.Confidence, result.CacheHit = cached.Confidence, true
+				if opts.Debug {
+					g.log(fmt.Sprintf("Cache hit: %s (cached %s)", key, cached.CreatedAt.Format(time.RFC3339)))
+				}
+				return nil
+			}
+			g.log(fmt.Sprintf("Ignoring the cached response, it is no longer valid: %v", err))
+		}
+	}
+	if opts.Debug && opts.Cache != nil {
+		g.log(fmt.Sprintf("Cache miss: %s", key))
+	}
+
+	var attempts []Attempt
+	if opts.Candidates > 1 {
+		var candidates []Candidate
+		result.Config, result.Name, result.Confidence, candidates, err = g.voteConfig(ctx, request, validator)
+		for i, candidate := range candidates {
+			attempts = append(attempts, candidate.Attempts...)
+			if err == nil && result.Candidate == 0 && candidate.Err == nil && candidate.Config == result.Config {
+				result.Candidate = i + 1
+			}
+		}
+	} else {
+		result.Config, result.Name, attempts, err = g.generateConfig(ctx, request, validator, 0)
+	}
+	result.Attempts = attempts
+	if err != nil {
+		return err
+	}
+	for _, attempt := range attempts {
+		result.Corrections = append(result.Corrections, attempt.Corrections...)
+	}
+
+	if opts.Cache != nil {
+		entry := CacheEntry{Hint: data.Hint, Model: opts.Model, Config: result.Config, Confidence: result.Confidence, CreatedAt: time.Now()}
+		if err := opts.Cache.Put(key, entry); err != nil {
+			g.log(fmt.Sprintf("Could not cache the response: %v", err))
+		}
+	}
+	return nil
+}
+
+// generateConfig queries the model up to MaxAttempts times until it returns a
+// CNI configuration that passes the validator. When an answer is rejected, the bad answer and the
+// reason it was rejected are appended to the conversation so the model can
+// correct itself on the next attempt. When the model can't be queried at all,
+// generation stops. candidate is the number of the candidate when voting, or
+// 0, it goes in front of every message logged to tell concurrent generations
+// apart.
+func (g *Generator) generateConfig(ctx context.Context, request ChatRequest, validator Validator, candidate int) (string, string, []Attempt, error) {
+	maxAttempts := g.opts.MaxAttempts
+	var attempts []Attempt
+	logPrefix := ""
+	if candidate > 0 {
+		logPrefix = fmt.Sprintf("Candidate %d/%d: ", candidate, g.opts.Candidates)
+	}
+	conversation := request
+	conversation.Messages = append([]ChatMessage{}, request.Messages...)
+
+	for i := 1; i <= maxAttempts; i++ {
+		attempt := Attempt{Candidate: candidate, Number: i, Prompt: conversation.Messages[:len(conversation.Messages):len(conversation.Messages)]}
+
+		response, err := g.queryLLM(ctx, conversation, candidate)
+		if err != nil {
+			// Asking again won't help, queryLLM already retried.
+			attempt.Err = err
+			attempts = append(attempts, attempt)
+			g.log(logPrefix + fmt.Sprintf("Attempt %d/%d failed: %v", i, maxAttempts, err))
+			break
+		}
+		attempt.Response = response
+
+		extractedjson, cniname, corrections, err := parseAndValidateJSON(response, validator)
+		if err != nil {
+			attempt.Err = err
+			attempts = append(attempts, attempt)
+			g.log(logPrefix + fmt.Sprintf("Attempt %d/%d failed: %v", i, maxAttempts, err))
+			conversation.Messages = append(conversation.Messages,
+				ChatMessage{Role: "assistant", Content: response},
+				ChatMessage{Role: "user", Content: repairPrompt(err)},
+			)
+			continue
+		}
+
+		attempt.Corrections = corrections
+		attempts = append(attempts, attempt)
+		for _, correction := range corrections {
+			g.log(logPrefix + correction)
+		}
+		g.log(logPrefix + fmt.Sprintf("Attempt %d/%d succeeded", i, maxAttempts))
+		return extractedjson, cniname, attempts, nil
+	}
+
+	return "", "", attempts, &GenerationError{Attempts: attempts}
+}
+
+// repairPrompt tells the model why its last answer was rejected.
+func repairPrompt(err error) string {
+	return fmt.Sprintf("That CNI configuration was rejected: %v\n"+
+		"Fix the problem and reply with only the corrected CNI configuration.", err)
+}
+
+// generateFromRules builds the config for a structured hint from the plugin
+// catalogue, and validates it just like an answer from the model.
+func (g *Generator) generateFromRules(validator Validator) (string, string, []string, error) {
+	built, err := buildFromRules(validator.Hint)
+	if err != nil {
+		return "", "", nil, &RulesError{Err: fmt.Errorf("error building the config from rules: %v", err)}
+	}
+
+	extractedjson, cniname, corrections, err := parseAndValidateJSON(built, validator)
+	if err != nil {
+		return "", "", nil, &RulesError{Err: fmt.Errorf("the config built from rules is invalid: %w", err)}
+	}
+	for _, correction := range corrections {
+		g.log(correction)
+	}
+
+	g.log("Built the config from rules, without querying the LLM")
+	return extractedjson, cniname, corrections, nil
+}
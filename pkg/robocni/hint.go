@@ -0,0 +1,392 @@
+package robocni
+
+import (
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// HintConstraints are the requirements that could be found in a hint without
+// the help of the model. Zero values mean the hint didn't say.
+type HintConstraints struct {
+	Hint       string
+	PluginType string
+	// Chained are the plugins to chain after the main plugin in a conflist.
+	Chained []string
+	Master  string
+	// DefaultMaster is the host's default route interface, which the rules
+	// use when the hint doesn't name a master. It is not found in the hint.
+	DefaultMaster string
+	// Ranges are the CIDRs to allocate addresses from, Excludes the ones to leave out.
+	Ranges   []*net.IPNet
+	Excludes []*net.IPNet
+	VLANs    []int
+	MTU      int
+	// IPAMType is the IPAM plugin asked for, or ipamNone for an L2 only network.
+	IPAMType string
+	// Namespace is where the net-attach-def should be created.
+	Namespace string
+}
+
+// ipamNone is the IPAMType of hints asking for no IPAM at all.
+const ipamNone = "none"
+
+// pluginKeywords are the main plugin types recognised in hints, in order of
+// precedence: "macvlan in bridge mode" is macvlan, "bridge with vlan 100"
+// is a bridge.
+var pluginKeywords = []struct {
+	Type    string
+	Pattern *regexp.Regexp
+}{
+	{"macvlan", regexp.MustCompile(`\bmacvlan\b`)},
+	{"ipvlan", regexp.MustCompile(`\bipvlan\b`)},
+	{"sriov", regexp.MustCompile(`\bsr-?iov\b`)},
+	{"host-device", regexp.MustCompile(`\bhost[- ]?device\b`)},
+	{"ptp", regexp.MustCompile(`\b(ptp|point[- ]to[- ]point)\b`)},
+	{"bridge", regexp.MustCompile(`\bbridge\b`)},
+	{"vlan", regexp.MustCompile(`\bvlan\b`)},
+}
+
+// chainKeywords are the chained plugins recognised in hints.
+var chainKeywords = []struct {
+	Type    string
+	Pattern *regexp.Regexp
+}{
+	{"tuning", regexp.MustCompile(`\btuning\b|\bsysctls?\b`)},
+	{"bandwidth", regexp.MustCompile(`\bbandwidth\b|\brate[- ]limit`)},
+	{"sbr", regexp.MustCompile(`\bsbr\b|\bsource[- ]based[- ]rout`)},
+	{"portmap", regexp.MustCompile(`\bportmap\b|\bport[- ]?mapping`)},
+}
+
+var ipamKeywords = []struct {
+	Type    string
+	Pattern *regexp.Regexp
+}{
+	{ipamNone, regexp.MustCompile(`\b(no|without( any)?)\s+ipam\b|\bl2[- ]only\b`)},
+	{"whereabouts", regexp.MustCompile(`\bwhereabouts\b`)},
+	{"host-local", regexp.MustCompile(`\bhost[- ]?local\b`)},
+	// "static" alone is often about routes, so it must be next to IPAM or addresses.
+	{"static", regexp.MustCompile(`\bstatic\s*=|\bstatic[\s-]+(?:ipam|ips?|ip[\s-]+address(?:es)?|address(?:es|ing)?)\b|\bipam[\s=:]+static\b`)},
+	{"dhcp", regexp.MustCompile(`\bdhcp\b`)},
+}
+
+var (
+	// Interface names are picked up after words like "on" or "master", and
+	// must contain a digit (eth0, ens5, bond0.100) to avoid catching plain words.
+	// Words like "for" or "to" are as often followed by a pod or node name.
+	masterPattern = regexp.MustCompile(`\b(?:master(?:ed)?(?:\s+to)?|on|interface|iface|dev|device|nic)[\s=:]+([a-z][\w.-]*\d[\w.-]*)`)
+	// Failing that, a word that looks like a common interface name will do.
+	ifnamePattern    = regexp.MustCompile(`\b((?:eth|ens|enp|eno|em|bond|team)[\w.-]*\d[\w.-]*)`)
+	vlanPattern      = regexp.MustCompile(`\bvlan(?:[\s_-]*id)?[\s=:#]*(\d{1,4})\b`)
+	namespacePattern = regexp.MustCompile(`\bnamespace[\s=:]+([a-z0-9][-a-z0-9]*)|\b(?:in|to)\s+the\s+([a-z0-9][-a-z0-9]*)\s+namespace\b`)
+	mtuPattern       = regexp.MustCompile(`\bmtu(?:\s+of)?[\s=:]*(\d{3,5})\b`)
+	// cidrPattern finds IPv4 and IPv6 CIDRs in free text.
+	cidrPattern = regexp.MustCompile(`(\d{1,3}(?:\.\d{1,3}){3}|[0-9a-fA-F]*:[0-9a-fA-F:]+)/\d{1,3}`)
+)
+
+// analyzeHint deterministically extracts the plugin type, master interface,
+// CIDRs, VLAN IDs, MTU and IPAM type from a hint.
+func analyzeHint(hint string) HintConstraints {
+	lower := strings.ToLower(hint)
+	constraints := HintConstraints{Hint: hint}
+
+	for _, keyword := range pluginKeywords {
+		if keyword.Pattern.MatchString(lower) {
+			constraints.PluginType = keyword.Type
+			break
+		}
+	}
+
+	for _, keyword := range chainKeywords {
+		if keyword.Pattern.MatchString(lower) {
+			constraints.Chained = append(constraints.Chained, keyword.Type)
+		}
+	}
+
+	for _, keyword := range ipamKeywords {
+		if keyword.Pattern.MatchString(lower) {
+			constraints.IPAMType = keyword.Type
+			break
+		}
+	}
+
+	// type= and ipam= say exactly what is wanted, whatever other keywords
+	// the hint contains.
+	values := hintValues(lower)
+	if plugin := values["type"]; plugin != "" {
+		constraints.PluginType = plugin
+	}
+	if ipamType := values["ipam"]; ipamType != "" {
+		constraints.IPAMType = ipamType
+	}
+
+	if match := masterPattern.FindStringSubmatch(lower); match != nil {
+		constraints.Master = strings.TrimRight(match[1], ".-")
+	} else if match := ifnamePattern.FindStringSubmatch(lower); match != nil {
+		constraints.Master = strings.TrimRight(match[1], ".-")
+	}
+
+	for _, match := range vlanPattern.FindAllStringSubmatch(lower, -1) {
+		if id, err := strconv.Atoi(match[1]); err == nil && id <= 4094 {
+			constraints.VLANs = append(constraints.VLANs, id)
+		}
+	}
+
+	if match := mtuPattern.FindStringSubmatch(lower); match != nil {
+		constraints.MTU, _ = strconv.Atoi(match[1])
+	}
+
+	if match := namespacePattern.FindStringSubmatch(lower); match != nil {
+		constraints.Namespace = strings.TrimRight(match[1]+match[2], "-")
+	}
+
+	constraints.Ranges, constraints.Excludes = hintCIDRs(hint)
+
+	return constraints
+}
+
+// String summarises the constraints for debug output.
+func (h HintConstraints) String() string {
+	var parts []string
+	add := func(name string, value string) {
+		if value != "" && value != "0" {
+			parts = append(parts, name+"="+value)
+		}
+	}
+	add("type", h.PluginType)
+	add("chained", strings.Join(h.Chained, ","))
+	add("master", h.Master)
+	add("ranges", netListOrEmpty(h.Ranges))
+	add("exclude", netListOrEmpty(h.Excludes))
+	add("vlan", joinInts(h.VLANs))
+	add("mtu", strconv.Itoa(h.MTU))
+	add("ipam", h.IPAMType)
+	add("namespace", h.Namespace)
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, " ")
+}
+
+func netListOrEmpty(nets []*net.IPNet) string {
+	if len(nets) == 0 {
+		return ""
+	}
+	return netList(nets)
+}
+
+// hintCIDRs returns the CIDRs written in the hint, split into the ranges to
+// allocate from and the ones to exclude.
+func hintCIDRs(hint string) ([]*net.IPNet, []*net.IPNet) {
+	rangeStrs, excludeStrs := hintCIDRStrings(hint)
+	return parseCIDRs(rangeStrs), parseCIDRs(excludeStrs)
+}
+
+// hintCIDRStrings returns the CIDRs in the hint as they were written, split
+// into the ranges to allocate from and the ones to exclude. Each CIDR is
+// classified by the words next to it, see cidrClass. CIDRs that aren't
+// clearly either, like the destination of a route, are left out.
+func hintCIDRStrings(hint string) ([]string, []string) {
+	var ranges, excludes []string
+	lower := strings.ToLower(hint)
+	previousEnd, previousClass := 0, cidrOther
+
+	for _, loc := range cidrPattern.FindAllStringIndex(hint, -1) {
+		cidr := hint[loc[0]:loc[1]]
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			continue
+		}
+
+		before := hintWords.FindAllString(lower[previousEnd:loc[0]], -1)
+		class := cidrClass(before, hintWords.FindString(lower[loc[1]:]))
+		// "excluding 10.0.0.8/29 and 10.0.0.16/29" excludes both.
+		if previousEnd > 0 && onlyConjunctions(lower[previousEnd:loc[0]]) {
+			class = previousClass
+		}
+
+		switch class {
+		case cidrRange:
+			ranges = append(ranges, cidr)
+		case cidrExclude:
+			excludes = append(excludes, cidr)
+		}
+		previousEnd, previousClass = loc[1], class
+	}
+
+	return ranges, excludes
+}
+
+// What a CIDR in a hint is for.
+const (
+	cidrOther = iota
+	cidrRange
+	cidrExclude
+	cidrRoute
+)
+
+var (
+	hintWords = regexp.MustCompile(`[a-z][a-z_-]*`)
+	// cidrWords are the words that tell what the CIDR following them is for.
+	cidrWords = map[string]int{
+		"exclude": cidrExclude, "excludes": cidrExclude, "excluding": cidrExclude,
+		"exclusion": cidrExclude, "exclusions": cidrExclude, "except": cidrExclude,
+		"route": cidrRoute, "routes": cidrRoute, "routing": cidrRoute, "to": cidrRoute,
+		"via": cidrRoute, "gateway": cidrRoute, "gw": cidrRoute, "dst": cidrRoute,
+		"destination": cidrRoute,
+		"from":        cidrRange, "range": cidrRange, "ranges": cidrRange, "ranged": cidrRange,
+		"subnet": cidrRange, "cidr": cidrRange, "pool": cidrRange, "network": cidrRange,
+		"addresses": cidrRange, "ips": cidrRange, "on": cidrRange, "in": cidrRange,
+		"for": cidrRange, "with": cidrRange, "using": cidrRange, "of": cidrRange,
+		"ipam": cidrRange, "whereabouts": cidrRange, "host-local": cidrRange, "static": cidrRange,
+	}
+	// cidrAfterWords tell what the CIDR before them is for, as in
+	// "10.0.0.0/24 range".
+	cidrAfterWords = map[string]int{
+		"range": cidrRange, "subnet": cidrRange, "network": cidrRange, "pool": cidrRange,
+		"route": cidrRoute,
+	}
+	conjunctionPattern = regexp.MustCompile(`^(?:[\s,&]|\band\b|\bor\b|\bplus\b)*$`)
+)
+
+// cidrClass classifies a CIDR by the closest of the few words before it that
+// says what it is for, or else by the word right after it.
+func cidrClass(before []string, after string) int {
+	for i := len(before) - 1; i >= 0 && i >= len(before)-4; i-- {
+		if class, ok := cidrWords[before[i]]; ok {
+			return class
+		}
+	}
+	if class, ok := cidrAfterWords[after]; ok {
+		return class
+	}
+	return cidrOther
+}
+
+func onlyConjunctions(text string) bool {
+	return conjunctionPattern.MatchString(text)
+}
+
+func parseCIDRs(cidrs []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		if _, ipnet, err := net.ParseCIDR(cidr); err == nil {
+			nets = append(nets, ipnet)
+		}
+	}
+	return nets
+}
+
+// check verifies that the configuration honours the plugin types, master,
+// VLAN, MTU and IPAM type constraints found in the hint. CIDRs are checked
+// along with the rest of the IPAM configuration.
+func (h HintConstraints) check(conf map[string]interface{}) ValidationErrors {
+	var errs ValidationErrors
+
+	// The constraints are mostly about the first plugin of a conflist,
+	// which creates the interface.
+	plugins, prefix := pluginsOf(conf)
+	if len(plugins) == 0 {
+		// Validation will complain about the empty list.
+		return errs
+	}
+
+	var types []string
+	for _, plugin := range plugins {
+		t, _ := plugin["type"].(string)
+		types = append(types, t)
+	}
+	for _, want := range h.Chained {
+		if !contains(types, want) {
+			errs.add("plugins", "the hint asks for the %s plugin, chain it after %s in a conflist plugins list", want, h.mainPlugin(types[0]))
+		}
+	}
+
+	if h.MTU != 0 {
+		found := false
+		for _, plugin := range plugins {
+			if mtu, _ := plugin["mtu"].(float64); int(mtu) == h.MTU {
+				found = true
+			}
+		}
+		if !found {
+			errs.add(prefix+"mtu", "the hint asks for an MTU of %d, not %v", h.MTU, plugins[0]["mtu"])
+		}
+	}
+
+	return append(errs, h.checkPlugin(plugins[0]).prefixed(prefix)...)
+}
+
+// mainPlugin names the plugin that should come first in a conflist.
+func (h HintConstraints) mainPlugin(fallback string) string {
+	if h.PluginType != "" {
+		return h.PluginType
+	}
+	return fallback
+}
+
+// checkPlugin verifies the interface-creating plugin honours the hint.
+func (h HintConstraints) checkPlugin(conf map[string]interface{}) ValidationErrors {
+	var errs ValidationErrors
+	plugin, _ := conf["type"].(string)
+
+	if h.PluginType != "" && plugin != h.PluginType {
+		errs.add("type", "the hint asks for %s, not %q", h.PluginType, plugin)
+		// The rest is unlikely to make sense for the wrong plugin.
+		return errs
+	}
+
+	if h.Master != "" {
+		if master, ok := conf["master"]; ok && master != h.Master {
+			errs.add("master", "the hint asks for %s, not %v", h.Master, master)
+		} else if !ok && (plugin == "macvlan" || plugin == "ipvlan" || plugin == "vlan") {
+			errs.add("master", "the hint asks for %s but master is not set", h.Master)
+		}
+	}
+
+	if len(h.VLANs) > 0 {
+		switch plugin {
+		case "vlan":
+			if id, _ := conf["vlanId"].(float64); !containsInt(h.VLANs, int(id)) {
+				errs.add("vlanId", "the hint asks for VLAN %s, not %v", joinInts(h.VLANs), conf["vlanId"])
+			}
+		case "sriov":
+			if id, _ := conf["vlan"].(float64); !containsInt(h.VLANs, int(id)) {
+				errs.add("vlan", "the hint asks for VLAN %s, not %v", joinInts(h.VLANs), conf["vlan"])
+			}
+		case "bridge":
+			_, trunk := conf["vlanTrunk"]
+			if id, _ := conf["vlan"].(float64); !trunk && !containsInt(h.VLANs, int(id)) {
+				errs.add("vlan", "the hint asks for VLAN %s, not %v", joinInts(h.VLANs), conf["vlan"])
+			}
+		}
+	}
+
+	ipam, _ := conf["ipam"].(map[string]interface{})
+	ipamType, _ := ipam["type"].(string)
+	switch {
+	case h.IPAMType == ipamNone && len(ipam) > 0:
+		errs.add("ipam", "the hint asks for no IPAM, use an empty ipam object")
+	case h.IPAMType != "" && h.IPAMType != ipamNone && ipamType != h.IPAMType:
+		errs.add("ipam.type", "the hint asks for %s, not %q", h.IPAMType, ipamType)
+	}
+
+	return errs
+}
+
+func containsInt(list []int, i int) bool {
+	for _, item := range list {
+		if item == i {
+			return true
+		}
+	}
+	return false
+}
+
+func joinInts(list []int) string {
+	var s []string
+	for _, i := range list {
+		s = append(s, strconv.Itoa(i))
+	}
+	return strings.Join(s, " or ")
+}
@@ -0,0 +1,165 @@
+package robocni
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHintCIDRStrings(t *testing.T) {
+	tests := []struct {
+		name         string
+		hint         string
+		wantRanges   []string
+		wantExcludes []string
+	}{
+		{
+			name:       "range after the IPAM name",
+			hint:       "macvlan on eth0 with whereabouts 10.40.0.0/24",
+			wantRanges: []string{"10.40.0.0/24"},
+		},
+		{
+			name:       "route destination is left out",
+			hint:       "macvlan on eth0 with whereabouts 10.40.0.0/24 and a route to 192.168.0.0/16",
+			wantRanges: []string{"10.40.0.0/24"},
+		},
+		{
+			name:       "route via is left out",
+			hint:       "bridge with host-local 10.10.0.0/16, routing 172.16.0.0/12 via the gateway",
+			wantRanges: []string{"10.10.0.0/16"},
+		},
+		{
+			name:         "exclusion before the range",
+			hint:         "whereabouts excluding 10.0.0.0/28 from 10.0.0.0/24",
+			wantRanges:   []string{"10.0.0.0/24"},
+			wantExcludes: []string{"10.0.0.0/28"},
+		},
+		{
+			name:         "exclusion after the range",
+			hint:         "ipvlan using 10.0.0.0/24, exclude 10.0.0.0/30",
+			wantRanges:   []string{"10.0.0.0/24"},
+			wantExcludes: []string{"10.0.0.0/30"},
+		},
+		{
+			name:         "exclusions joined by and",
+			hint:         "whereabouts range 10.0.0.0/24 excluding 10.0.0.8/29 and 10.0.0.16/29",
+			wantRanges:   []string{"10.0.0.0/24"},
+			wantExcludes: []string{"10.0.0.8/29", "10.0.0.16/29"},
+		},
+		{
+			name:       "ranges joined by a comma",
+			hint:       "host-local with 10.10.0.0/16, fd00::/64",
+			wantRanges: []string{"10.10.0.0/16", "fd00::/64"},
+		},
+		{
+			name:       "word after the CIDR",
+			hint:       "macvlan, 192.168.50.0/24 range",
+			wantRanges: []string{"192.168.50.0/24"},
+		},
+		{
+			name:       "key=value hint",
+			hint:       "type=macvlan master=eth0 whereabouts=10.40.0.0/24",
+			wantRanges: []string{"10.40.0.0/24"},
+		},
+		{
+			name: "CIDR with nothing saying what it's for",
+			hint: "macvlan 10.40.0.0/24",
+		},
+		{
+			name: "invalid CIDR",
+			hint: "macvlan with whereabouts 10.40.0.0/33",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranges, excludes := hintCIDRStrings(tt.hint)
+			if !reflect.DeepEqual(ranges, tt.wantRanges) {
+				t.Errorf("hintCIDRStrings(%q) ranges = %v, want %v", tt.hint, ranges, tt.wantRanges)
+			}
+			if !reflect.DeepEqual(excludes, tt.wantExcludes) {
+				t.Errorf("hintCIDRStrings(%q) excludes = %v, want %v", tt.hint, excludes, tt.wantExcludes)
+			}
+		})
+	}
+}
+
+func TestAnalyzeHint(t *testing.T) {
+	tests := []struct {
+		name string
+		hint string
+		want HintConstraints
+	}{
+		{
+			name: "static routes aren't static IPAM",
+			hint: "macvlan on eth0 with static routes",
+			want: HintConstraints{PluginType: "macvlan", Master: "eth0"},
+		},
+		{
+			name: "static IPAM",
+			hint: "ipvlan on ens5 with static ipam",
+			want: HintConstraints{PluginType: "ipvlan", Master: "ens5", IPAMType: "static"},
+		},
+		{
+			name: "static IP addresses",
+			hint: "host-device for eth1 using static IP addresses",
+			want: HintConstraints{PluginType: "host-device", Master: "eth1", IPAMType: "static"},
+		},
+		{
+			name: "ipam=static",
+			hint: "type=bridge ipam=static",
+			want: HintConstraints{PluginType: "bridge", IPAMType: "static"},
+		},
+		{
+			name: "static= key",
+			hint: "type=macvlan master=eth0 static=10.10.0.5/24",
+			want: HintConstraints{PluginType: "macvlan", Master: "eth0", IPAMType: "static"},
+		},
+		{
+			name: "pod name after for isn't a master",
+			hint: "macvlan for pod2 with static ip 10.1.1.5/24",
+			want: HintConstraints{PluginType: "macvlan", IPAMType: "static"},
+		},
+		{
+			name: "node name after for isn't a master",
+			hint: "macvlan for node2 on eth0",
+			want: HintConstraints{PluginType: "macvlan", Master: "eth0"},
+		},
+		{
+			name: "interface name after to",
+			hint: "ipvlan mastered to ens5f1",
+			want: HintConstraints{PluginType: "ipvlan", Master: "ens5f1"},
+		},
+		{
+			name: "type= and ipam= win over keywords",
+			hint: "type=vlan master=eth0 vlan=100 bridge=br0 ipam=dhcp whereabouts=10.1.0.0/16",
+			want: HintConstraints{PluginType: "vlan", Master: "eth0", VLANs: []int{100}, IPAMType: "dhcp"},
+		},
+		{
+			name: "no IPAM",
+			hint: "bridge without any ipam, mtu 9000",
+			want: HintConstraints{PluginType: "bridge", MTU: 9000, IPAMType: ipamNone},
+		},
+		{
+			name: "macvlan in bridge mode",
+			hint: "macvlan in bridge mode over bond0.100 with dhcp",
+			want: HintConstraints{PluginType: "macvlan", Master: "bond0.100", IPAMType: "dhcp"},
+		},
+		{
+			name: "bridge with vlan",
+			hint: "bridge with vlan 100, host-local",
+			want: HintConstraints{PluginType: "bridge", VLANs: []int{100}, IPAMType: "host-local"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := analyzeHint(tt.hint)
+			// CIDRs are covered by TestHintCIDRStrings.
+			got.Ranges, got.Excludes = nil, nil
+			tt.want.Hint = tt.hint
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("analyzeHint(%q) = %v, want %v", tt.hint, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package robocni
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HostInterface is a network interface found on the host.
+type HostInterface struct {
+	Name string
+	// Kind is "device" for physical interfaces, otherwise the link kind,
+	// such as "veth", "bond", "vlan" or "bridge".
+	Kind  string
+	MTU   int
+	State string
+	MAC   string
+	// Master is the bridge or bond the interface is enslaved to, if any.
+	Master    string
+	Addresses []string
+}
+
+// HostRoute is a route found on the host, Dst is "default" for the default route.
+type HostRoute struct {
+	Dst     string
+	Gateway string
+	Dev     string
+	Metric  int
+}
+
+// HostNetwork is what robocni knows about the host's networking.
+type HostNetwork struct {
+	Interfaces []HostInterface
+	Routes     []HostRoute
+}
+
+// InterfacesSummary describes the interfaces compactly, one per line, for the prompt.
+func (h *HostNetwork) InterfacesSummary() string {
+	var lines []string
+	for _, intf := range h.Interfaces {
+		line := fmt.Sprintf("%s: kind %s, mtu %d, state %s", intf.Name, intf.Kind, intf.MTU, intf.State)
+		if intf.Master != "" {
+			line += ", master " + intf.Master
+		}
+		if len(intf.Addresses) > 0 {
+			line += ", addresses " + strings.Join(intf.Addresses, " ")
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// RoutesSummary describes the routes in the same form as 'ip route', for the prompt.
+func (h *HostNetwork) RoutesSummary() string {
+	var lines []string
+	for _, route := range h.Routes {
+		line := route.Dst
+		if route.Gateway != "" {
+			line += " via " + route.Gateway
+		}
+		if route.Dev != "" {
+			line += " dev " + route.Dev
+		}
+		if route.Metric != 0 {
+			line += fmt.Sprintf(" metric %d", route.Metric)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
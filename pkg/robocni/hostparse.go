@@ -0,0 +1,324 @@
+package robocni
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ParseIPLink parses the output of 'ip link show' or 'ip addr', as text or
+// as JSON from 'ip -j', with or without -d details.
+func ParseIPLink(content string) ([]HostInterface, error) {
+	if strings.HasPrefix(strings.TrimSpace(content), "[") {
+		return parseIPLinkJSON(content)
+	}
+	return parseIPLinkText(content)
+}
+
+// ParseIPRoute parses the output of 'ip route', as text or as JSON from 'ip -j'.
+func ParseIPRoute(content string) ([]HostRoute, error) {
+	if strings.HasPrefix(strings.TrimSpace(content), "[") {
+		return parseIPRouteJSON(content)
+	}
+	return parseIPRouteText(content)
+}
+
+// ReadHostFiles reads the host's networking from dumps of 'ip link' and
+// 'ip route', either of which may be "". A dump that can't be parsed is
+// returned as is, to give to the LLM.
+func ReadHostFiles(linkFile string, routeFile string) (*HostNetwork, string, string, error) {
+	var ifs, routes string
+	host := &HostNetwork{}
+
+	if linkFile != "" {
+		content, err := ioutil.ReadFile(linkFile)
+		if err != nil {
+			return nil, "", "", fmt.Errorf("error reading IP address file %s: %v", linkFile, err)
+		}
+		if host.Interfaces, err = ParseIPLink(string(content)); err != nil {
+			ifs = string(content)
+		}
+	}
+
+	if routeFile != "" {
+		content, err := ioutil.ReadFile(routeFile)
+		if err != nil {
+			return nil, "", "", fmt.Errorf("error reading routes file %s: %v", routeFile, err)
+		}
+		if host.Routes, err = ParseIPRoute(string(content)); err != nil {
+			routes = string(content)
+		}
+	}
+
+	return host, ifs, routes, nil
+}
+
+type ipLinkJSON struct {
+	IfName    string `json:"ifname"`
+	MTU       int    `json:"mtu"`
+	OperState string `json:"operstate"`
+	Address   string `json:"address"`
+	Master    string `json:"master"`
+	LinkType  string `json:"link_type"`
+	LinkInfo  *struct {
+		InfoKind string `json:"info_kind"`
+	} `json:"linkinfo"`
+	AddrInfo []struct {
+		Local     string `json:"local"`
+		PrefixLen int    `json:"prefixlen"`
+	} `json:"addr_info"`
+}
+
+func parseIPLinkJSON(content string) ([]HostInterface, error) {
+	var links []ipLinkJSON
+	if err := json.Unmarshal([]byte(content), &links); err != nil {
+		return nil, fmt.Errorf("error parsing ip -j link output: %v", err)
+	}
+
+	var interfaces []HostInterface
+	for _, link := range links {
+		intf := HostInterface{
+			Name:   link.IfName,
+			MTU:    link.MTU,
+			State:  link.OperState,
+			MAC:    link.Address,
+			Master: link.Master,
+		}
+		details := ""
+		if link.LinkInfo != nil {
+			details = link.LinkInfo.InfoKind
+		}
+		intf.Kind = guessKind(link.IfName, link.LinkType, details)
+		for _, addr := range link.AddrInfo {
+			intf.Addresses = append(intf.Addresses, fmt.Sprintf("%s/%d", addr.Local, addr.PrefixLen))
+		}
+		interfaces = append(interfaces, intf)
+	}
+
+	return interfaces, nil
+}
+
+var (
+	// 2: eth0@if5: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc noqueue master cni0 state UP ...
+	linkHeaderPattern = regexp.MustCompile(`^\d+:\s+([^:\s]+):\s+<[^>]*>(.*)$`)
+	// link/ether 52:54:00:12:34:56 brd ff:ff:ff:ff:ff:ff
+	linkTypePattern = regexp.MustCompile(`^\s+link/(\S+)(?:\s+(\S+))?`)
+	// inet 10.0.0.5/24 brd 10.0.0.255 scope global ens5
+	linkAddrPattern = regexp.MustCompile(`^\s+inet6?\s+(\S+)`)
+	// The first word of the -d details line, e.g. "    vlan protocol 802.1Q id 100"
+	linkDetailsPattern = regexp.MustCompile(`^\s+([a-z][a-z0-9_]*)\b`)
+)
+
+func parseIPLinkText(content string) ([]HostInterface, error) {
+	var interfaces []HostInterface
+	var current *HostInterface
+	var linkType, details string
+
+	finish := func() {
+		if current != nil {
+			current.Kind = guessKind(current.Name, linkType, details)
+			// The master is named without the "@peer" suffix.
+			if at := strings.Index(current.Name, "@"); at != -1 {
+				current.Name = current.Name[:at]
+			}
+			interfaces = append(interfaces, *current)
+		}
+	}
+
+	for _, line := range strings.Split(content, "\n") {
+		if match := linkHeaderPattern.FindStringSubmatch(line); match != nil {
+			finish()
+			current = &HostInterface{Name: match[1]}
+			linkType, details = "", ""
+			fields := strings.Fields(match[2])
+			for i := 0; i+1 < len(fields); i++ {
+				switch fields[i] {
+				case "mtu":
+					current.MTU, _ = strconv.Atoi(fields[i+1])
+				case "state":
+					current.State = fields[i+1]
+				case "master":
+					current.Master = fields[i+1]
+				}
+			}
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		if match := linkTypePattern.FindStringSubmatch(line); match != nil {
+			linkType = match[1]
+			if linkType == "ether" {
+				current.MAC = match[2]
+			}
+			continue
+		}
+		if match := linkAddrPattern.FindStringSubmatch(line); match != nil {
+			current.Addresses = append(current.Addresses, match[1])
+			continue
+		}
+		if match := linkDetailsPattern.FindStringSubmatch(line); match != nil && details == "" && linkType != "" {
+			details = match[1]
+		}
+	}
+	finish()
+
+	if len(interfaces) == 0 {
+		return nil, errors.New("no interfaces found in ip link output")
+	}
+	return interfaces, nil
+}
+
+// Link kinds that 'ip -d link' shows on the details line.
+var knownKinds = []string{"veth", "bridge", "bond", "vlan", "macvlan", "ipvlan", "vxlan", "geneve", "team", "dummy", "tun", "ifb", "bridge_slave", "bond_slave"}
+
+// guessKind works out the link kind, from the -d details when we have them,
+// otherwise from the interface name.
+func guessKind(name string, linkType string, details string) string {
+	if linkType == "loopback" {
+		return "loopback"
+	}
+	if contains(knownKinds, details) && !strings.HasSuffix(details, "_slave") {
+		return details
+	}
+
+	base := name
+	if at := strings.Index(name, "@"); at != -1 {
+		base = name[:at]
+		// Names like eth0@if12 are the container end of a veth pair.
+		if strings.HasPrefix(name[at+1:], "if") {
+			return "veth"
+		}
+	}
+	switch {
+	case strings.HasPrefix(base, "veth"):
+		return "veth"
+	case strings.HasPrefix(base, "bond"):
+		return "bond"
+	case strings.HasPrefix(base, "br") || base == "cni0" || base == "docker0":
+		return "bridge"
+	case strings.Contains(base, "."):
+		return "vlan"
+	case strings.HasPrefix(base, "vxlan") || strings.HasPrefix(base, "flannel"):
+		return "vxlan"
+	}
+	return "device"
+}
+
+type ipRouteJSON struct {
+	Dst     string `json:"dst"`
+	Gateway string `json:"gateway"`
+	Dev     string `json:"dev"`
+	Metric  int    `json:"metric"`
+}
+
+func parseIPRouteJSON(content string) ([]HostRoute, error) {
+	var entries []ipRouteJSON
+	if err := json.Unmarshal([]byte(content), &entries); err != nil {
+		return nil, fmt.Errorf("error parsing ip -j route output: %v", err)
+	}
+
+	var routes []HostRoute
+	for _, entry := range entries {
+		routes = append(routes, HostRoute{Dst: entry.Dst, Gateway: entry.Gateway, Dev: entry.Dev, Metric: entry.Metric})
+	}
+	return routes, nil
+}
+
+func parseIPRouteText(content string) ([]HostRoute, error) {
+	var routes []HostRoute
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		// Lines that don't start with a destination aren't routes, and when
+		// none are the content is something else, to hand over as is.
+		if len(fields) == 0 || !isRouteDst(fields[0]) {
+			continue
+		}
+		route := HostRoute{Dst: fields[0]}
+		for i := 1; i+1 < len(fields); i++ {
+			switch fields[i] {
+			case "via":
+				route.Gateway = fields[i+1]
+			case "dev":
+				route.Dev = fields[i+1]
+			case "metric":
+				route.Metric, _ = strconv.Atoi(fields[i+1])
+			}
+		}
+		routes = append(routes, route)
+	}
+
+	if len(routes) == 0 {
+		return nil, errors.New("no routes found in ip route output")
+	}
+	return routes, nil
+}
+
+// isRouteDst reports whether the first word of an ip route line is a
+// destination: "default", a CIDR or a single address.
+func isRouteDst(word string) bool {
+	if word == "default" || net.ParseIP(word) != nil {
+		return true
+	}
+	_, _, err := net.ParseCIDR(word)
+	return err == nil
+}
+
+// DefaultInterface returns the device of the default route with the lowest metric.
+func (h *HostNetwork) DefaultInterface() string {
+	var defaults []HostRoute
+	for _, route := range h.Routes {
+		if route.Dst == "default" && route.Dev != "" {
+			defaults = append(defaults, route)
+		}
+	}
+	if len(defaults) == 0 {
+		return ""
+	}
+	sort.SliceStable(defaults, func(i, j int) bool { return defaults[i].Metric < defaults[j].Metric })
+	return defaults[0].Dev
+}
+
+// noisePrefixes are interfaces created by container networking, which the
+// model should never use as a master.
+var noisePrefixes = []string{"veth", "cni", "flannel", "cali", "cilium", "lxc", "weave", "vxlan", "genev", "tunl", "kube-", "docker", "ovs-", "br-int"}
+
+// isNoise reports whether an interface is loopback or container plumbing.
+func isNoise(intf HostInterface) bool {
+	if intf.Kind == "loopback" || intf.Kind == "veth" || intf.Name == "lo" {
+		return true
+	}
+	for _, prefix := range noisePrefixes {
+		if strings.HasPrefix(intf.Name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Filtered returns the host network without loopback, veth and CNI
+// interfaces, or the routes through them.
+func (h *HostNetwork) Filtered() *HostNetwork {
+	filtered := &HostNetwork{}
+	kept := map[string]bool{}
+	for _, intf := range h.Interfaces {
+		if isNoise(intf) {
+			continue
+		}
+		kept[intf.Name] = true
+		filtered.Interfaces = append(filtered.Interfaces, intf)
+	}
+	for _, route := range h.Routes {
+		// Keep routes when we don't know the interfaces at all.
+		if len(h.Interfaces) == 0 || kept[route.Dev] {
+			filtered.Routes = append(filtered.Routes, route)
+		}
+	}
+	return filtered
+}
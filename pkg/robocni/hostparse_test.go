@@ -0,0 +1,212 @@
+package robocni
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseIPRoute(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []HostRoute
+		wantErr bool
+	}{
+		{
+			name: "text",
+			content: `default via 10.0.0.1 dev ens5 proto dhcp metric 100
+10.0.0.0/24 dev ens5 proto kernel scope link src 10.0.0.5 metric 100
+169.254.169.254 via 10.0.0.1 dev ens5
+`,
+			want: []HostRoute{
+				{Dst: "default", Gateway: "10.0.0.1", Dev: "ens5", Metric: 100},
+				{Dst: "10.0.0.0/24", Dev: "ens5", Metric: 100},
+				{Dst: "169.254.169.254", Gateway: "10.0.0.1", Dev: "ens5"},
+			},
+		},
+		{
+			name:    "text with lines that aren't routes",
+			content: "$ ip route\ndefault via 10.0.0.1 dev ens5\n",
+			want:    []HostRoute{{Dst: "default", Gateway: "10.0.0.1", Dev: "ens5"}},
+		},
+		{
+			name:    "JSON",
+			content: `[{"dst":"default","gateway":"10.0.0.1","dev":"ens5","metric":100},{"dst":"10.0.0.0/24","dev":"ens5"}]`,
+			want: []HostRoute{
+				{Dst: "default", Gateway: "10.0.0.1", Dev: "ens5", Metric: 100},
+				{Dst: "10.0.0.0/24", Dev: "ens5"},
+			},
+		},
+		{
+			name:    "invalid JSON",
+			content: `[{"dst":`,
+			wantErr: true,
+		},
+		{
+			name:    "ip link output",
+			content: "1: lo: <LOOPBACK,UP,LOWER_UP> mtu 65536 qdisc noqueue state UNKNOWN\n    link/loopback 00:00:00:00:00:00 brd 00:00:00:00:00:00\n",
+			wantErr: true,
+		},
+		{
+			name:    "prose",
+			content: "the default route goes out of eth0\n",
+			wantErr: true,
+		},
+		{
+			name:    "empty",
+			content: "",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routes, err := ParseIPRoute(tt.content)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseIPRoute() = %v, want an error", routes)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseIPRoute() error: %v", err)
+			}
+			if !reflect.DeepEqual(routes, tt.want) {
+				t.Errorf("ParseIPRoute() = %v, want %v", routes, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseIPLink(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []HostInterface
+		wantErr bool
+	}{
+		{
+			name: "text",
+			content: `1: lo: <LOOPBACK,UP,LOWER_UP> mtu 65536 qdisc noqueue state UNKNOWN group default qlen 1000
+    link/loopback 00:00:00:00:00:00 brd 00:00:00:00:00:00
+    inet 127.0.0.1/8 scope host lo
+2: ens5: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 9001 qdisc mq state UP group default qlen 1000
+    link/ether 52:54:00:12:34:56 brd ff:ff:ff:ff:ff:ff
+    inet 10.0.0.5/24 brd 10.0.0.255 scope global ens5
+5: veth1a2b@if4: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1450 qdisc noqueue master cni0 state UP
+    link/ether 6e:1c:00:00:00:01 brd ff:ff:ff:ff:ff:ff link-netnsid 0
+`,
+			want: []HostInterface{
+				{Name: "lo", Kind: "loopback", MTU: 65536, State: "UNKNOWN", Addresses: []string{"127.0.0.1/8"}},
+				{Name: "ens5", Kind: "device", MTU: 9001, State: "UP", MAC: "52:54:00:12:34:56", Addresses: []string{"10.0.0.5/24"}},
+				{Name: "veth1a2b", Kind: "veth", MTU: 1450, State: "UP", MAC: "6e:1c:00:00:00:01", Master: "cni0"},
+			},
+		},
+		{
+			name: "text with details",
+			content: `3: bond0.100@bond0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc noqueue state UP
+    link/ether 52:54:00:12:34:57 brd ff:ff:ff:ff:ff:ff promiscuity 0
+    vlan protocol 802.1Q id 100 <REORDER_HDR>
+`,
+			want: []HostInterface{
+				{Name: "bond0.100", Kind: "vlan", MTU: 1500, State: "UP", MAC: "52:54:00:12:34:57"},
+			},
+		},
+		{
+			name:    "JSON",
+			content: `[{"ifname":"ens5","mtu":9001,"operstate":"UP","address":"52:54:00:12:34:56","link_type":"ether","addr_info":[{"local":"10.0.0.5","prefixlen":24}]},{"ifname":"br0","mtu":1500,"link_type":"ether","linkinfo":{"info_kind":"bridge"}}]`,
+			want: []HostInterface{
+				{Name: "ens5", Kind: "device", MTU: 9001, State: "UP", MAC: "52:54:00:12:34:56", Addresses: []string{"10.0.0.5/24"}},
+				{Name: "br0", Kind: "bridge", MTU: 1500},
+			},
+		},
+		{
+			name:    "ip route output",
+			content: "default via 10.0.0.1 dev ens5\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interfaces, err := ParseIPLink(tt.content)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseIPLink() = %v, want an error", interfaces)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseIPLink() error: %v", err)
+			}
+			if !reflect.DeepEqual(interfaces, tt.want) {
+				t.Errorf("ParseIPLink() = %+v, want %+v", interfaces, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadHostFiles(t *testing.T) {
+	dir := t.TempDir()
+	linkFile := filepath.Join(dir, "link")
+	routeFile := filepath.Join(dir, "route")
+	rawRoutes := "the default route goes out of eth0\n"
+	if err := os.WriteFile(linkFile, []byte("2: ens5: <UP> mtu 1500 state UP\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(routeFile, []byte(rawRoutes), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	host, ifs, routes, err := ReadHostFiles(linkFile, routeFile)
+	if err != nil {
+		t.Fatalf("ReadHostFiles() error: %v", err)
+	}
+	if len(host.Interfaces) != 1 || ifs != "" {
+		t.Errorf("ReadHostFiles() interfaces = %v and %q, want ens5 parsed", host.Interfaces, ifs)
+	}
+	// Routes that can't be parsed are handed over as they are.
+	if len(host.Routes) != 0 || routes != rawRoutes {
+		t.Errorf("ReadHostFiles() routes = %v and %q, want the raw content", host.Routes, routes)
+	}
+}
+
+func TestDefaultInterface(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes []HostRoute
+		want   string
+	}{
+		{
+			name:   "no default route",
+			routes: []HostRoute{{Dst: "10.0.0.0/24", Dev: "ens5"}},
+		},
+		{
+			name: "lowest metric wins",
+			routes: []HostRoute{
+				{Dst: "default", Dev: "wlan0", Metric: 600},
+				{Dst: "default", Dev: "ens5", Metric: 100},
+			},
+			want: "ens5",
+		},
+		{
+			name: "first of equal metrics",
+			routes: []HostRoute{
+				{Dst: "default", Dev: "ens5"},
+				{Dst: "default", Dev: "ens6"},
+			},
+			want: "ens5",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := &HostNetwork{Routes: tt.routes}
+			if got := host.DefaultInterface(); got != tt.want {
+				t.Errorf("DefaultInterface() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
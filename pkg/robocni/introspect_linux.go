@@ -0,0 +1,73 @@
+//go:build linux
+
+package robocni
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// IntrospectLocal reads the links, addresses and routes of the host robocni
+// runs on using netlink.
+func IntrospectLocal() (*HostNetwork, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("error listing links: %v", err)
+	}
+
+	names := map[int]string{}
+	for _, link := range links {
+		names[link.Attrs().Index] = link.Attrs().Name
+	}
+
+	host := &HostNetwork{}
+	for _, link := range links {
+		attrs := link.Attrs()
+		kind := link.Type()
+		if attrs.Flags&net.FlagLoopback != 0 {
+			kind = "loopback"
+		}
+		intf := HostInterface{
+			Name:   attrs.Name,
+			Kind:   kind,
+			MTU:    attrs.MTU,
+			State:  strings.ToUpper(attrs.OperState.String()),
+			Master: names[attrs.MasterIndex],
+		}
+		if attrs.HardwareAddr != nil {
+			intf.MAC = attrs.HardwareAddr.String()
+		}
+
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return nil, fmt.Errorf("error listing addresses of %s: %v", attrs.Name, err)
+		}
+		for _, addr := range addrs {
+			intf.Addresses = append(intf.Addresses, addr.IPNet.String())
+		}
+
+		host.Interfaces = append(host.Interfaces, intf)
+	}
+
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("error listing routes: %v", err)
+	}
+	for _, route := range routes {
+		r := HostRoute{Dst: "default", Dev: names[route.LinkIndex], Metric: route.Priority}
+		if route.Dst != nil {
+			if ones, _ := route.Dst.Mask.Size(); ones != 0 || !route.Dst.IP.IsUnspecified() {
+				r.Dst = route.Dst.String()
+			}
+		}
+		if route.Gw != nil {
+			r.Gateway = route.Gw.String()
+		}
+		host.Routes = append(host.Routes, r)
+	}
+
+	return host, nil
+}
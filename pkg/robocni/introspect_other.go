@@ -0,0 +1,12 @@
+//go:build !linux
+
+package robocni
+
+import (
+	"errors"
+)
+
+// IntrospectLocal is only possible with netlink, on Linux.
+func IntrospectLocal() (*HostNetwork, error) {
+	return nil, errors.New("local network introspection is only supported on Linux")
+}
@@ -0,0 +1,332 @@
+package robocni
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// validateIPAM checks that the addressing in an ipam block is consistent,
+// and that it uses the ranges and exclusions the user asked for in the hint.
+func validateIPAM(ipam map[string]interface{}, hint HintConstraints) ValidationErrors {
+	var errs ValidationErrors
+	var configured, excluded []*net.IPNet
+
+	ipamType, _ := ipam["type"].(string)
+	switch ipamType {
+	case "whereabouts":
+		if _, ok := ipam["ipRanges"]; !ok {
+			if _, ok := ipam["range"]; !ok {
+				errs.add("ipam.range", "field is required for whereabouts")
+			}
+		}
+		r, x := validateWhereaboutsRange(ipam, "ipam.", &errs)
+		configured, excluded = append(configured, r...), append(excluded, x...)
+		for i, item := range listOfObjects(ipam, "ipRanges", "ipam.", &errs) {
+			r, x := validateWhereaboutsRange(item, fmt.Sprintf("ipam.ipRanges[%d].", i), &errs)
+			configured, excluded = append(configured, r...), append(excluded, x...)
+		}
+	case "host-local":
+		configured = validateHostLocal(ipam, &errs)
+		validateRoutes(ipam, "ipam.", &errs)
+	case "static":
+		configured = validateStatic(ipam, &errs)
+		validateRoutes(ipam, "ipam.", &errs)
+	default:
+		// dhcp and other IPAM plugins don't carry addressing we can check,
+		// so they can't use the CIDRs written in the hint either.
+		if len(hint.Ranges) > 0 {
+			if ipamType == "" {
+				errs.add("ipam", "the hint asks for %s but no IPAM configures addresses", netList(hint.Ranges))
+			} else {
+				errs.add("ipam", "the hint asks for %s but the %s IPAM doesn't configure addresses", netList(hint.Ranges), ipamType)
+			}
+		}
+		return errs
+	}
+
+	if len(errs) > 0 {
+		// Don't compare with the hint until the block itself makes sense.
+		return errs
+	}
+
+	for _, want := range hint.Ranges {
+		if !containsNet(configured, want) {
+			errs.add("ipam", "the hint asks for %s but the %s IPAM configures %s", want, ipamType, netList(configured))
+		}
+	}
+	for _, want := range hint.Excludes {
+		if !containsNet(excluded, want) {
+			errs.add("ipam.exclude", "the hint asks to exclude %s but it is not excluded", want)
+		}
+	}
+
+	return errs
+}
+
+// validateWhereaboutsRange checks a whereabouts range, with its optional
+// range_start, range_end and exclude, and returns the range and exclusions.
+func validateWhereaboutsRange(conf map[string]interface{}, prefix string, errs *ValidationErrors) ([]*net.IPNet, []*net.IPNet) {
+	value, ok := conf["range"]
+	if !ok {
+		return nil, nil
+	}
+	rangeStr, ok := value.(string)
+	if !ok {
+		errs.add(prefix+"range", "must be a string")
+		return nil, nil
+	}
+
+	// Whereabouts also accepts the "start-end/prefix" form.
+	var start net.IP
+	if dash := strings.Index(rangeStr, "-"); dash != -1 {
+		start = net.ParseIP(rangeStr[:dash])
+		if start == nil {
+			errs.add(prefix+"range", "%q does not start with a valid IP", rangeStr)
+			return nil, nil
+		}
+		rangeStr = rangeStr[dash+1:]
+	}
+	ip, ipnet, err := net.ParseCIDR(rangeStr)
+	if err != nil {
+		errs.add(prefix+"range", "%q is not a valid CIDR", rangeStr)
+		return nil, nil
+	}
+	if start != nil && (!ipnet.Contains(start) || bytes.Compare(start.To16(), ip.To16()) > 0) {
+		errs.add(prefix+"range", "start %s must be within %s and before %s", start, ipnet, ip)
+	}
+
+	rangeStart := ipInNet(conf, "range_start", ipnet, prefix, errs)
+	rangeEnd := ipInNet(conf, "range_end", ipnet, prefix, errs)
+	if rangeStart != nil && rangeEnd != nil && bytes.Compare(rangeStart.To16(), rangeEnd.To16()) > 0 {
+		errs.add(prefix+"range_end", "%s is before range_start %s", rangeEnd, rangeStart)
+	}
+
+	var excluded []*net.IPNet
+	for i, cidr := range listOfStrings(conf, "exclude", prefix, errs) {
+		field := fmt.Sprintf("%sexclude[%d]", prefix, i)
+		_, exclude, err := net.ParseCIDR(cidr)
+		if err != nil {
+			errs.add(field, "%q is not a valid CIDR", cidr)
+			continue
+		}
+		if !netWithin(exclude, ipnet) {
+			errs.add(field, "%s is not inside the range %s", exclude, ipnet)
+			continue
+		}
+		excluded = append(excluded, exclude)
+	}
+
+	return []*net.IPNet{ipnet}, excluded
+}
+
+// validateHostLocal checks both the single subnet and the "ranges" forms
+// of host-local, returning the configured subnets.
+func validateHostLocal(ipam map[string]interface{}, errs *ValidationErrors) []*net.IPNet {
+	var configured []*net.IPNet
+
+	_, hasSubnet := ipam["subnet"]
+	_, hasRanges := ipam["ranges"]
+	if !hasSubnet && !hasRanges {
+		errs.add("ipam.subnet", "host-local requires either subnet or ranges")
+		return nil
+	}
+
+	if hasSubnet {
+		if subnet := validateHostLocalRange(ipam, "ipam.", errs); subnet != nil {
+			configured = append(configured, subnet)
+		}
+	}
+
+	if hasRanges {
+		rangeSets, ok := ipam["ranges"].([]interface{})
+		if !ok {
+			errs.add("ipam.ranges", "must be a list of lists of ranges")
+			return configured
+		}
+		for i, set := range rangeSets {
+			items, ok := set.([]interface{})
+			if !ok {
+				errs.add(fmt.Sprintf("ipam.ranges[%d]", i), "must be a list of ranges")
+				continue
+			}
+			for j, item := range items {
+				prefix := fmt.Sprintf("ipam.ranges[%d][%d].", i, j)
+				r, ok := item.(map[string]interface{})
+				if !ok {
+					errs.add(strings.TrimSuffix(prefix, "."), "must be an object")
+					continue
+				}
+				if subnet := validateHostLocalRange(r, prefix, errs); subnet != nil {
+					configured = append(configured, subnet)
+				}
+			}
+		}
+	}
+
+	return configured
+}
+
+// validateHostLocalRange checks a host-local subnet with its optional
+// rangeStart, rangeEnd and gateway.
+func validateHostLocalRange(conf map[string]interface{}, prefix string, errs *ValidationErrors) *net.IPNet {
+	subnetStr, ok := conf["subnet"].(string)
+	if !ok {
+		errs.add(prefix+"subnet", "field is required and must be a string")
+		return nil
+	}
+	_, subnet, err := net.ParseCIDR(subnetStr)
+	if err != nil {
+		errs.add(prefix+"subnet", "%q is not a valid CIDR", subnetStr)
+		return nil
+	}
+
+	rangeStart := ipInNet(conf, "rangeStart", subnet, prefix, errs)
+	rangeEnd := ipInNet(conf, "rangeEnd", subnet, prefix, errs)
+	if rangeStart != nil && rangeEnd != nil && bytes.Compare(rangeStart.To16(), rangeEnd.To16()) > 0 {
+		errs.add(prefix+"rangeEnd", "%s is before rangeStart %s", rangeEnd, rangeStart)
+	}
+	ipInNet(conf, "gateway", subnet, prefix, errs)
+
+	return subnet
+}
+
+// validateStatic checks static IPAM addresses, returning their subnets.
+func validateStatic(ipam map[string]interface{}, errs *ValidationErrors) []*net.IPNet {
+	var configured []*net.IPNet
+
+	if _, ok := ipam["addresses"]; !ok {
+		errs.add("ipam.addresses", "field is required for static IPAM")
+	}
+
+	for i, item := range listOfObjects(ipam, "addresses", "ipam.", errs) {
+		prefix := fmt.Sprintf("ipam.addresses[%d].", i)
+		address, ok := item["address"].(string)
+		if !ok {
+			errs.add(prefix+"address", "field is required and must be a string")
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(address)
+		if err != nil {
+			errs.add(prefix+"address", "%q is not a valid address in CIDR notation", address)
+			continue
+		}
+		ipInNet(item, "gateway", subnet, prefix, errs)
+		configured = append(configured, subnet)
+	}
+
+	return configured
+}
+
+// validateRoutes checks the destinations and gateways of IPAM routes.
+func validateRoutes(conf map[string]interface{}, prefix string, errs *ValidationErrors) {
+	for i, route := range listOfObjects(conf, "routes", prefix, errs) {
+		field := fmt.Sprintf("%sroutes[%d].", prefix, i)
+		dst, ok := route["dst"].(string)
+		if !ok {
+			errs.add(field+"dst", "field is required and must be a string")
+		} else if _, _, err := net.ParseCIDR(dst); err != nil {
+			errs.add(field+"dst", "%q is not a valid CIDR", dst)
+		}
+		if gw, ok := route["gw"]; ok {
+			if s, _ := gw.(string); net.ParseIP(s) == nil {
+				errs.add(field+"gw", "%v is not a valid IP", gw)
+			}
+		}
+	}
+}
+
+// ipInNet parses the named IP field of conf, if set, and checks it is in ipnet.
+func ipInNet(conf map[string]interface{}, name string, ipnet *net.IPNet, prefix string, errs *ValidationErrors) net.IP {
+	value, ok := conf[name]
+	if !ok {
+		return nil
+	}
+	s, _ := value.(string)
+	ip := net.ParseIP(s)
+	if ip == nil {
+		errs.add(prefix+name, "%v is not a valid IP", value)
+		return nil
+	}
+	if !ipnet.Contains(ip) {
+		errs.add(prefix+name, "%s is not inside %s", ip, ipnet)
+		return nil
+	}
+	return ip
+}
+
+// listOfStrings returns the named list of strings from conf, if set.
+func listOfStrings(conf map[string]interface{}, name string, prefix string, errs *ValidationErrors) []string {
+	value, ok := conf[name]
+	if !ok {
+		return nil
+	}
+	items, ok := value.([]interface{})
+	if !ok {
+		errs.add(prefix+name, "must be a list")
+		return nil
+	}
+	var list []string
+	for i, item := range items {
+		s, ok := item.(string)
+		if !ok {
+			errs.add(fmt.Sprintf("%s%s[%d]", prefix, name, i), "must be a string")
+			continue
+		}
+		list = append(list, s)
+	}
+	return list
+}
+
+// listOfObjects returns the named list of objects from conf, if set.
+func listOfObjects(conf map[string]interface{}, name string, prefix string, errs *ValidationErrors) []map[string]interface{} {
+	value, ok := conf[name]
+	if !ok {
+		return nil
+	}
+	items, ok := value.([]interface{})
+	if !ok {
+		errs.add(prefix+name, "must be a list")
+		return nil
+	}
+	var list []map[string]interface{}
+	for i, item := range items {
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			errs.add(fmt.Sprintf("%s%s[%d]", prefix, name, i), "must be an object")
+			continue
+		}
+		list = append(list, obj)
+	}
+	return list
+}
+
+// netWithin reports whether inner is entirely contained in outer.
+func netWithin(inner, outer *net.IPNet) bool {
+	innerOnes, _ := inner.Mask.Size()
+	outerOnes, _ := outer.Mask.Size()
+	return outer.Contains(inner.IP) && innerOnes >= outerOnes
+}
+
+// containsNet reports whether want is one of nets, comparing networks so
+// that 10.40.0.15/27 and 10.40.0.0/27 are the same.
+func containsNet(nets []*net.IPNet, want *net.IPNet) bool {
+	for _, n := range nets {
+		if n.IP.Equal(want.IP) && bytes.Equal(n.Mask, want.Mask) {
+			return true
+		}
+	}
+	return false
+}
+
+func netList(nets []*net.IPNet) string {
+	if len(nets) == 0 {
+		return "no range"
+	}
+	var list []string
+	for _, n := range nets {
+		list = append(list, n.String())
+	}
+	return strings.Join(list, ", ")
+}
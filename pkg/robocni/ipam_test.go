@@ -0,0 +1,171 @@
+package robocni
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestValidateIPAM(t *testing.T) {
+	tests := []struct {
+		name string
+		ipam string
+		hint string
+		// want are the fields with errors, in order.
+		want []string
+	}{
+		{
+			name: "whereabouts range from the hint",
+			ipam: `{"type": "whereabouts", "range": "10.40.0.0/24"}`,
+			hint: "macvlan with whereabouts 10.40.0.0/24",
+		},
+		{
+			name: "whereabouts range written from a host address",
+			ipam: `{"type": "whereabouts", "range": "10.40.0.15/27"}`,
+			hint: "macvlan with whereabouts 10.40.0.0/27",
+		},
+		{
+			name: "whereabouts with a different range",
+			ipam: `{"type": "whereabouts", "range": "192.0.2.0/24"}`,
+			hint: "macvlan with whereabouts 10.40.0.0/24",
+			want: []string{"ipam"},
+		},
+		{
+			name: "whereabouts without a range",
+			ipam: `{"type": "whereabouts"}`,
+			want: []string{"ipam.range"},
+		},
+		{
+			name: "whereabouts with an invalid range",
+			ipam: `{"type": "whereabouts", "range": "10.40.0.0/33"}`,
+			want: []string{"ipam.range"},
+		},
+		{
+			name: "whereabouts start-end range form",
+			ipam: `{"type": "whereabouts", "range": "10.40.0.10-10.40.0.20/24"}`,
+		},
+		{
+			name: "whereabouts range_start and range_end out of order",
+			ipam: `{"type": "whereabouts", "range": "10.40.0.0/24", "range_start": "10.40.0.20", "range_end": "10.40.0.10"}`,
+			want: []string{"ipam.range_end"},
+		},
+		{
+			name: "whereabouts range_start outside the range",
+			ipam: `{"type": "whereabouts", "range": "10.40.0.0/24", "range_start": "10.41.0.1"}`,
+			want: []string{"ipam.range_start"},
+		},
+		{
+			name: "whereabouts exclusions from the hint",
+			ipam: `{"type": "whereabouts", "range": "10.40.0.0/24", "exclude": ["10.40.0.0/28"]}`,
+			hint: "whereabouts excluding 10.40.0.0/28 from 10.40.0.0/24",
+		},
+		{
+			name: "whereabouts missing an exclusion from the hint",
+			ipam: `{"type": "whereabouts", "range": "10.40.0.0/24"}`,
+			hint: "whereabouts on 10.40.0.0/24 excluding 10.40.0.0/28",
+			want: []string{"ipam.exclude"},
+		},
+		{
+			name: "whereabouts exclusion outside the range",
+			ipam: `{"type": "whereabouts", "range": "10.40.0.0/24", "exclude": ["10.41.0.0/28"]}`,
+			want: []string{"ipam.exclude[0]"},
+		},
+		{
+			name: "whereabouts ipRanges",
+			ipam: `{"type": "whereabouts", "ipRanges": [{"range": "10.40.0.0/24"}, {"range": "fd00::/64"}]}`,
+			hint: "whereabouts with fd00::/64",
+		},
+		{
+			name: "route in the hint isn't a range",
+			ipam: `{"type": "whereabouts", "range": "10.40.0.0/24"}`,
+			hint: "macvlan with whereabouts 10.40.0.0/24 and a route to 192.168.0.0/16",
+		},
+		{
+			name: "host-local subnet with gateway",
+			ipam: `{"type": "host-local", "subnet": "10.10.0.0/16", "rangeStart": "10.10.1.1", "rangeEnd": "10.10.1.100", "gateway": "10.10.0.1"}`,
+			hint: "bridge with host-local 10.10.0.0/16",
+		},
+		{
+			name: "host-local gateway outside the subnet",
+			ipam: `{"type": "host-local", "subnet": "10.10.0.0/16", "gateway": "10.11.0.1"}`,
+			want: []string{"ipam.gateway"},
+		},
+		{
+			name: "host-local without subnet or ranges",
+			ipam: `{"type": "host-local"}`,
+			want: []string{"ipam.subnet"},
+		},
+		{
+			name: "host-local ranges",
+			ipam: `{"type": "host-local", "ranges": [[{"subnet": "10.10.0.0/16"}], [{"subnet": "10.20.0.0/16", "rangeStart": "10.30.0.1"}]]}`,
+			hint: "bridge with host-local 10.10.0.0/16",
+			want: []string{"ipam.ranges[1][0].rangeStart"},
+		},
+		{
+			name: "host-local route with an invalid dst",
+			ipam: `{"type": "host-local", "subnet": "10.10.0.0/16", "routes": [{"dst": "0.0.0.0"}]}`,
+			want: []string{"ipam.routes[0].dst"},
+		},
+		{
+			name: "static addresses",
+			ipam: `{"type": "static", "addresses": [{"address": "10.10.0.5/24", "gateway": "10.10.0.1"}]}`,
+			hint: "host-device with static IP 10.10.0.0/24",
+		},
+		{
+			name: "static without addresses",
+			ipam: `{"type": "static"}`,
+			want: []string{"ipam.addresses"},
+		},
+		{
+			name: "static address without a prefix",
+			ipam: `{"type": "static", "addresses": [{"address": "10.10.0.5"}]}`,
+			want: []string{"ipam.addresses[0].address"},
+		},
+		{
+			name: "dhcp without CIDRs in the hint",
+			ipam: `{"type": "dhcp"}`,
+			hint: "macvlan on eth0 with dhcp",
+		},
+		{
+			name: "empty ipam without CIDRs in the hint",
+			ipam: `{}`,
+			hint: "an L2 only bridge",
+		},
+		{
+			name: "dhcp can't use the hint's CIDRs",
+			ipam: `{"type": "dhcp"}`,
+			hint: "macvlan on eth0 with 10.40.0.0/24",
+			want: []string{"ipam"},
+		},
+		{
+			name: "empty ipam can't use the hint's CIDRs",
+			ipam: `{}`,
+			hint: "macvlan on eth0 with 10.40.0.0/24",
+			want: []string{"ipam"},
+		},
+		{
+			name: "missing ipam can't use the hint's CIDRs",
+			hint: "macvlan on eth0 with 10.40.0.0/24",
+			want: []string{"ipam"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ipam map[string]interface{}
+			if tt.ipam != "" {
+				if err := json.Unmarshal([]byte(tt.ipam), &ipam); err != nil {
+					t.Fatalf("bad test ipam: %v", err)
+				}
+			}
+
+			var fields []string
+			for _, err := range validateIPAM(ipam, analyzeHint(tt.hint)) {
+				fields = append(fields, err.Field)
+			}
+			if !reflect.DeepEqual(fields, tt.want) {
+				t.Errorf("validateIPAM() errors on %v, want %v: %v", fields, tt.want, validateIPAM(ipam, analyzeHint(tt.hint)))
+			}
+		})
+	}
+}
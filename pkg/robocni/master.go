@@ -0,0 +1,96 @@
+package robocni
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// masterProblem returns why the named interface can't be used as a master,
+// or an empty string when it can.
+func (h *HostNetwork) masterProblem(name string) string {
+	for _, intf := range h.Interfaces {
+		if intf.Name != name {
+			continue
+		}
+		switch {
+		case intf.Kind == "loopback":
+			return fmt.Sprintf("%s is the loopback interface", name)
+		case intf.Kind == "veth":
+			return fmt.Sprintf("%s is a veth", name)
+		case intf.Master != "":
+			return fmt.Sprintf("%s is enslaved to %s", name, intf.Master)
+		case intf.State == "DOWN":
+			return fmt.Sprintf("%s is down", name)
+		}
+		return ""
+	}
+	return fmt.Sprintf("%s does not exist on the host", name)
+}
+
+// usableMasters lists the interfaces that can be used as a master, with the
+// default route interface first.
+func (h *HostNetwork) usableMasters() []string {
+	var usable []string
+	if def := h.DefaultInterface(); def != "" && h.masterProblem(def) == "" {
+		usable = append(usable, def)
+	}
+	for _, intf := range h.Interfaces {
+		if isNoise(intf) || contains(usable, intf.Name) || h.masterProblem(intf.Name) != "" {
+			continue
+		}
+		usable = append(usable, intf.Name)
+	}
+	return usable
+}
+
+// verifyMaster checks the master of the interface plugin against the host.
+// Unusable masters are replaced with the best usable one when v.FixMaster is
+// set, returning the corrected JSON and what was changed, and rejected otherwise.
+func verifyMaster(jsonStr string, conf map[string]interface{}, v Validator) (string, []string, ValidationErrors) {
+	var errs ValidationErrors
+	if v.Host == nil || len(v.Host.Interfaces) == 0 {
+		return jsonStr, nil, nil
+	}
+
+	plugins, prefix := pluginsOf(conf)
+	if len(plugins) == 0 {
+		return jsonStr, nil, nil
+	}
+	master, ok := plugins[0]["master"].(string)
+	if !ok || master == v.Hint.Master {
+		// An interface the user asked for by name is their call.
+		return jsonStr, nil, nil
+	}
+
+	problem := v.Host.masterProblem(master)
+	if problem == "" {
+		return jsonStr, nil, nil
+	}
+
+	// The master the hint asks for comes first, even if it's not usable.
+	usable := v.Host.usableMasters()
+	if v.Hint.Master != "" {
+		usable = []string{v.Hint.Master}
+	}
+	if len(usable) == 0 {
+		errs.add(prefix+"master", "%s and no other interface on the host can be used", problem)
+		return jsonStr, nil, errs
+	}
+	if !v.FixMaster {
+		errs.add(prefix+"master", "%s, use one of: %s", problem, strings.Join(usable, ", "))
+		return jsonStr, nil, errs
+	}
+
+	// Edit the JSON text rather than re-marshalling the map, to keep the field order.
+	pattern := regexp.MustCompile(`("master"\s*:\s*)"` + regexp.QuoteMeta(master) + `"`)
+	loc := pattern.FindStringSubmatchIndex(jsonStr)
+	if loc == nil {
+		errs.add(prefix+"master", "%s, use one of: %s", problem, strings.Join(usable, ", "))
+		return jsonStr, nil, errs
+	}
+	corrected := jsonStr[:loc[3]] + `"` + usable[0] + `"` + jsonStr[loc[1]:]
+	plugins[0]["master"] = usable[0]
+
+	return corrected, []string{fmt.Sprintf("Corrected master: %s, using %s instead", problem, usable[0])}, nil
+}
@@ -0,0 +1,133 @@
+package robocni
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// testHost has a usable default route interface, a bridge with a member,
+// a veth and an interface that is down.
+var testHost = &HostNetwork{
+	Interfaces: []HostInterface{
+		{Name: "lo", Kind: "loopback", State: "UNKNOWN"},
+		{Name: "br0", Kind: "bridge", State: "UP"},
+		{Name: "eth0", Kind: "device", State: "UP", Master: "br0"},
+		{Name: "eth1", Kind: "device", State: "UP"},
+		{Name: "eth2", Kind: "device", State: "DOWN"},
+		{Name: "veth1a2b", Kind: "veth", State: "UP"},
+	},
+	Routes: []HostRoute{
+		{Dst: "default", Gateway: "10.0.0.1", Dev: "br0"},
+	},
+}
+
+func TestMasterProblem(t *testing.T) {
+	tests := []struct {
+		name    string
+		master  string
+		problem bool
+	}{
+		{name: "device", master: "eth1"},
+		{name: "bridge", master: "br0"},
+		{name: "bridge member", master: "eth0", problem: true},
+		{name: "down", master: "eth2", problem: true},
+		{name: "veth", master: "veth1a2b", problem: true},
+		{name: "loopback", master: "lo", problem: true},
+		{name: "missing", master: "eth9", problem: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problem := testHost.masterProblem(tt.master)
+			if (problem != "") != tt.problem {
+				t.Errorf("masterProblem(%s) = %q, want a problem: %v", tt.master, problem, tt.problem)
+			}
+		})
+	}
+}
+
+func TestUsableMasters(t *testing.T) {
+	want := []string{"br0", "eth1"}
+	if got := testHost.usableMasters(); !reflect.DeepEqual(got, want) {
+		t.Errorf("usableMasters() = %v, want %v", got, want)
+	}
+}
+
+func TestVerifyMaster(t *testing.T) {
+	tests := []struct {
+		name      string
+		conf      string
+		hint      string
+		fixMaster bool
+		// want is the master after verification, wantErr whether it's rejected.
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "usable master",
+			conf: `{"name": "mv", "type": "macvlan", "master": "eth1"}`,
+			want: "eth1",
+		},
+		{
+			name: "default route bridge",
+			conf: `{"name": "mv", "type": "macvlan", "master": "br0"}`,
+			want: "br0",
+		},
+		{
+			name:      "bridge member fixed",
+			conf:      `{"name": "mv", "type": "macvlan", "master": "eth0"}`,
+			fixMaster: true,
+			want:      "br0",
+		},
+		{
+			name:    "bridge member rejected",
+			conf:    `{"name": "mv", "type": "macvlan", "master": "eth0"}`,
+			want:    "eth0",
+			wantErr: true,
+		},
+		{
+			name:      "missing master in a conflist fixed",
+			conf:      `{"name": "mv", "plugins": [{"type": "macvlan", "master": "eth9"}, {"type": "tuning"}]}`,
+			fixMaster: true,
+			want:      "br0",
+		},
+		{
+			name:      "fixed to the master in the hint",
+			conf:      `{"name": "mv", "type": "macvlan", "master": "eth9"}`,
+			hint:      "macvlan on eth1",
+			fixMaster: true,
+			want:      "eth1",
+		},
+		{
+			name: "master in the hint is kept",
+			conf: `{"name": "mv", "type": "macvlan", "master": "eth2"}`,
+			hint: "macvlan on eth2",
+			want: "eth2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conf map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.conf), &conf); err != nil {
+				t.Fatalf("bad test config: %v", err)
+			}
+
+			v := Validator{Hint: analyzeHint(tt.hint), Host: testHost, FixMaster: tt.fixMaster}
+			corrected, _, errs := verifyMaster(tt.conf, conf, v)
+			if (len(errs) > 0) != tt.wantErr {
+				t.Errorf("verifyMaster() errors = %v, want an error: %v", errs, tt.wantErr)
+			}
+
+			var got map[string]interface{}
+			if err := json.Unmarshal([]byte(corrected), &got); err != nil {
+				t.Fatalf("verifyMaster() returned invalid JSON: %v", err)
+			}
+			plugins, _ := pluginsOf(got)
+			if master := plugins[0]["master"]; master != tt.want {
+				t.Errorf("verifyMaster() master = %v, want %s", master, tt.want)
+			}
+		})
+	}
+}
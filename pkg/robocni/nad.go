@@ -0,0 +1,112 @@
+package robocni
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// NetworkAttachmentDefinition is the Multus custom resource wrapping a CNI configuration.
+type NetworkAttachmentDefinition struct {
+	APIVersion string                          `json:"apiVersion" yaml:"apiVersion"`
+	Kind       string                          `json:"kind" yaml:"kind"`
+	Metadata   NetworkAttachmentDefinitionMeta `json:"metadata" yaml:"metadata"`
+	Spec       NetworkAttachmentDefinitionSpec `json:"spec" yaml:"spec"`
+}
+
+type NetworkAttachmentDefinitionMeta struct {
+	Name        string            `json:"name" yaml:"name"`
+	Namespace   string            `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty" yaml:"annotations,omitempty"`
+}
+
+// NetworkAttachmentDefinitionSpec holds the CNI configuration, which is
+// either a single plugin configuration or a conflist, as a JSON string.
+type NetworkAttachmentDefinitionSpec struct {
+	Config string `json:"config" yaml:"config"`
+}
+
+// AnnotationPrefix namespaces the annotations robocni adds to net-attach-defs.
+const AnnotationPrefix = "robocni.dougbtv.io/"
+
+// newNetAttachDef builds a net-attach-def with the given metadata around the
+// CNI configuration, re-indenting it, or compacting it onto one line.
+func newNetAttachDef(meta NetworkAttachmentDefinitionMeta, cniconfig string, compact bool) (*NetworkAttachmentDefinition, error) {
+	config, err := NormalizeJSON(cniconfig, compact)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NetworkAttachmentDefinition{
+		APIVersion: "k8s.cni.cncf.io/v1",
+		Kind:       "NetworkAttachmentDefinition",
+		Metadata:   meta,
+		Spec:       NetworkAttachmentDefinitionSpec{Config: config},
+	}, nil
+}
+
+// provenanceAnnotations record how a net-attach-def was generated, the model
+// is empty when it was built from rules.
+func provenanceAnnotations(hint string, model string, provider string, generatedAt time.Time) map[string]string {
+	annotations := map[string]string{
+		AnnotationPrefix + "hint":         hint,
+		AnnotationPrefix + "provider":     provider,
+		AnnotationPrefix + "generated-at": generatedAt.UTC().Format(time.RFC3339),
+	}
+	if model != "" {
+		annotations[AnnotationPrefix+"model"] = model
+	}
+	return annotations
+}
+
+// NormalizeJSON replaces the model's formatting of the JSON with our own,
+// keeping the order of the fields.
+func NormalizeJSON(str string, compact bool) (string, error) {
+	var out bytes.Buffer
+	var err error
+	if compact {
+		err = json.Compact(&out, []byte(str))
+	} else {
+		err = json.Indent(&out, []byte(str), "", "  ")
+	}
+	if err != nil {
+		return "", fmt.Errorf("error formatting CNI config: %v", err)
+	}
+	return out.String(), nil
+}
+
+// RenderNetAttachDef marshals the net-attach-def as YAML, or as JSON.
+func RenderNetAttachDef(nad *NetworkAttachmentDefinition, asJSON bool) (string, error) {
+	if asJSON {
+		out, err := json.MarshalIndent(nad, "", "  ")
+		if err != nil {
+			return "", fmt.Errorf("error marshalling net-attach-def to JSON: %v", err)
+		}
+		return string(out) + "\n", nil
+	}
+
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(nad); err != nil {
+		return "", fmt.Errorf("error marshalling net-attach-def to YAML: %v", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return "", fmt.Errorf("error marshalling net-attach-def to YAML: %v", err)
+	}
+	return out.String(), nil
+}
+
+// formatOptions renders generation options as JSON, with sorted keys, so a
+// run can be replayed with the same options.
+func formatOptions(options map[string]interface{}) string {
+	out, err := json.Marshal(options)
+	if err != nil {
+		return ""
+	}
+	return string(out)
+}
@@ -0,0 +1,220 @@
+package robocni
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+//go:embed templates/system_prompt.txt templates/query.txt templates/cni_schema.json templates/examples/*.txt
+var templatesBlob embed.FS
+
+// Templates finds the prompt templates and examples, preferring the files in
+// Dir over the built in ones. Template names are relative to the templates
+// directory, like "query.txt" or "examples/macvlan.txt".
+type Templates struct {
+	Dir string
+	// SystemPrompt, when set, is the path of the system prompt template,
+	// overriding Dir.
+	SystemPrompt string
+}
+
+// Template Structs
+type QueryTemplateData struct {
+	Interfaces string
+	Routes     string
+	Hint       string
+	// DefaultInterface is the device of the host's default route, if known.
+	DefaultInterface string
+	// Fenced asks the model to wrap its answer in triple backticks, which is
+	// needed when the provider cannot constrain the output format itself.
+	Fenced bool
+}
+
+// Example is a few-shot example: a hint and the CNI configuration it should produce.
+type Example struct {
+	Name   string
+	Hint   string
+	Config string
+}
+
+// buildConversation assembles the chat sent to the model: the system rules,
+// a user/assistant pair per example, and finally the user's hint.
+func buildConversation(templates Templates, data QueryTemplateData, examples []Example) ([]ChatMessage, error) {
+	system, err := templates.Render("system_prompt.txt", data)
+	if err != nil {
+		return nil, err
+	}
+
+	query, err := templates.Render("query.txt", data)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []ChatMessage{{Role: "system", Content: strings.TrimSpace(system)}}
+	for _, example := range examples {
+		answer := example.Config
+		if data.Fenced {
+			answer = "```json\n" + answer + "\n```"
+		}
+		messages = append(messages,
+			ChatMessage{Role: "user", Content: "Now create a CNI configuration given this hint:\n\n" + example.Hint},
+			ChatMessage{Role: "assistant", Content: answer},
+		)
+	}
+	messages = append(messages, ChatMessage{Role: "user", Content: strings.TrimSpace(query)})
+
+	return messages, nil
+}
+
+// outputFormats are the values of the -format flag.
+var outputFormats = []string{"schema", "json", "none"}
+
+// outputFormat returns the ChatRequest.Format for the -format flag value:
+// "schema" for the CNI configuration JSON schema, "json" for any JSON
+// object, or "none" to leave the output unconstrained.
+func outputFormat(templates Templates, name string) (json.RawMessage, error) {
+	switch name {
+	case "schema":
+		schema, err := templates.Read("cni_schema.json")
+		if err != nil {
+			return nil, fmt.Errorf("error reading CNI schema: %v", err)
+		}
+		return json.RawMessage(schema), nil
+	case "json":
+		return json.RawMessage(`"json"`), nil
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q, must be one of: %s", name, strings.Join(outputFormats, ", "))
+	}
+}
+
+// Examples reads every example, sorted by file name. An example in Dir
+// replaces the built in example of the same file name.
+func (t Templates) Examples() ([]Example, error) {
+	files := map[string][]byte{}
+	entries, err := templatesBlob.ReadDir("templates/examples")
+	if err != nil {
+		return nil, fmt.Errorf("error reading examples: %v", err)
+	}
+	for _, entry := range entries {
+		content, err := templatesBlob.ReadFile(path.Join("templates/examples", entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("error reading example %s: %v", entry.Name(), err)
+		}
+		files[entry.Name()] = content
+	}
+
+	if t.Dir != "" {
+		matches, err := filepath.Glob(filepath.Join(t.Dir, "examples", "*.txt"))
+		if err != nil {
+			return nil, fmt.Errorf("error reading examples: %v", err)
+		}
+		for _, match := range matches {
+			content, err := os.ReadFile(match)
+			if err != nil {
+				return nil, fmt.Errorf("error reading example %s: %v", match, err)
+			}
+			files[filepath.Base(match)] = content
+		}
+	}
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var examples []Example
+	for _, name := range names {
+		example, err := parseExample(strings.TrimSuffix(name, ".txt"), string(files[name]))
+		if err != nil {
+			return nil, err
+		}
+		examples = append(examples, example)
+	}
+
+	return examples, nil
+}
+
+// parseExample parses an example file, which is a "hint: ..." header, a line
+// containing only "---", and then the CNI configuration.
+func parseExample(name string, content string) (Example, error) {
+	parts := strings.SplitN(content, "\n---\n", 2)
+	if len(parts) != 2 {
+		return Example{}, fmt.Errorf("example %s is missing the --- separator", name)
+	}
+
+	example := Example{Name: name, Config: strings.TrimSpace(parts[1])}
+	for _, line := range strings.Split(parts[0], "\n") {
+		if strings.HasPrefix(line, "hint:") {
+			example.Hint = strings.TrimSpace(strings.TrimPrefix(line, "hint:"))
+		}
+	}
+	if example.Hint == "" {
+		return Example{}, fmt.Errorf("example %s is missing a hint: line", name)
+	}
+
+	return example, nil
+}
+
+// Read returns the contents of the named template.
+func (t Templates) Read(name string) ([]byte, error) {
+	if name == "system_prompt.txt" && t.SystemPrompt != "" {
+		content, err := os.ReadFile(t.SystemPrompt)
+		if err != nil {
+			return nil, fmt.Errorf("error reading template %s: %v", t.SystemPrompt, err)
+		}
+		return content, nil
+	}
+
+	if t.Dir != "" {
+		content, err := os.ReadFile(filepath.Join(t.Dir, name))
+		if err == nil {
+			return content, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("error reading template %s: %v", name, err)
+		}
+	}
+
+	content, err := templatesBlob.ReadFile(path.Join("templates", name))
+	if err != nil {
+		return nil, fmt.Errorf("error reading template %s: %v", name, err)
+	}
+	return content, nil
+}
+
+// Render executes the named template.
+func (t Templates) Render(name string, data interface{}) (string, error) {
+	tmpl, err := t.Read(name)
+	if err != nil {
+		return "", err
+	}
+	return executeTemplate(name, string(tmpl), data)
+}
+
+// executeTemplate parses and executes tmpl, naming it name in errors.
+func executeTemplate(name string, tmpl string, data interface{}) (string, error) {
+	t, err := template.New(path.Base(name)).Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("error parsing template %s: %v", name, err)
+	}
+
+	var tpl bytes.Buffer
+	err = t.Execute(&tpl, data)
+	if err != nil {
+		return "", fmt.Errorf("error executing template %s: %v", name, err)
+	}
+
+	return tpl.String(), nil
+}
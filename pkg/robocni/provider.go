@@ -0,0 +1,353 @@
+package robocni
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// LLMProvider turns a chat conversation into generated text using some LLM backend.
+type LLMProvider interface {
+	// Name returns the short name of the provider, as used by the -provider flag.
+	Name() string
+	// SupportsFormat reports whether the provider can constrain its output
+	// to JSON, or to a JSON schema, using ChatRequest.Format.
+	SupportsFormat() bool
+	// Chat sends the conversation to the model and returns the assistant's reply.
+	Chat(ctx context.Context, request ChatRequest) (string, error)
+}
+
+// Embedder is implemented by providers that can compute text embeddings.
+type Embedder interface {
+	Embed(ctx context.Context, model string, text string) ([]float64, error)
+}
+
+// ChatRequest is a conversation to send to the model.
+type ChatRequest struct {
+	Messages []ChatMessage
+	// Format, when set, is either the JSON string "json" or a JSON schema
+	// that the reply must conform to. It is only honoured by providers
+	// whose SupportsFormat returns true.
+	Format json.RawMessage
+	// Options are generation options using Ollama's names, like temperature,
+	// seed or num_predict.
+	Options map[string]interface{}
+	// Stream, when set, is called with each piece of the reply as it arrives,
+	// by providers that stream their replies. Returning false cuts the reply
+	// short, and Chat returns what arrived so far.
+	Stream func(token string) bool
+}
+
+// ChatMessage is a single turn of a chat conversation, with a role of
+// "system", "user" or "assistant".
+type ChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// Define a struct to unmarshal the JSON response
+type LLMResponse struct {
+	Model     string      `json:"model"`
+	CreatedAt string      `json:"created_at"`
+	Message   ChatMessage `json:"message"`
+	Done      bool        `json:"done"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// OllamaProvider talks to the Ollama /api/chat endpoint.
+type OllamaProvider struct {
+	BaseURL string
+	Model   string
+	Client  *http.Client
+}
+
+// OpenAIProvider talks to any OpenAI-compatible /v1/chat/completions endpoint,
+// such as vLLM, llama.cpp server or LocalAI.
+type OpenAIProvider struct {
+	BaseURL string
+	Model   string
+	APIKey  string
+	Client  *http.Client
+}
+
+type chatRequest struct {
+	Model    string                 `json:"model"`
+	Messages []ChatMessage          `json:"messages"`
+	Format   json.RawMessage        `json:"format,omitempty"`
+	Options  map[string]interface{} `json:"options,omitempty"`
+}
+
+// openAIOptions maps Ollama option names to the OpenAI request fields, other
+// options aren't supported by the OpenAI API.
+var openAIOptions = map[string]string{
+	"temperature": "temperature",
+	"top_p":       "top_p",
+	"seed":        "seed",
+	"stop":        "stop",
+	"num_predict": "max_tokens",
+}
+
+type openAIResponse struct {
+	Choices []struct {
+		Message ChatMessage `json:"message"`
+	} `json:"choices"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// Defaults for the timeouts of NewHTTPClient.
+const (
+	DefaultConnectTimeout = 10 * time.Second
+	DefaultTimeout        = 5 * time.Minute
+)
+
+// StatusError is a reply from the LLM service with a status other than 200 OK.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	// Message is the error the service gave, if any.
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%s returned %d %s", e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("%s returned %d %s: %s", e.URL, e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// NewHTTPClient returns a client for the LLM service, that gives up
+// connecting after connectTimeout, and on the whole request, including
+// generating the reply, after timeout. Zero means no timeout.
+func NewHTTPClient(connectTimeout time.Duration, timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = connectTimeout
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+// NewProvider builds the LLMProvider selected by name. The endpoint, when
+// set, overrides the URL otherwise built from host and port. A nil client
+// uses NewHTTPClient with the default timeouts.
+func NewProvider(name, endpoint, host, port, model, apiKey string, client *http.Client) (LLMProvider, error) {
+	baseURL := strings.TrimSuffix(endpoint, "/")
+	if baseURL == "" {
+		baseURL = "http://" + host + ":" + port
+	}
+	if client == nil {
+		client = NewHTTPClient(DefaultConnectTimeout, DefaultTimeout)
+	}
+
+	switch name {
+	case "ollama":
+		return &OllamaProvider{BaseURL: baseURL, Model: model, Client: client}, nil
+	case "openai":
+		return &OpenAIProvider{BaseURL: baseURL, Model: model, APIKey: apiKey, Client: client}, nil
+	default:
+		return nil, fmt.Errorf("unknown provider %q, must be one of: ollama, openai", name)
+	}
+}
+
+func (p *OllamaProvider) Name() string {
+	return "ollama"
+}
+
+func (p *OllamaProvider) SupportsFormat() bool {
+	return true
+}
+
+func (p *OllamaProvider) Chat(ctx context.Context, request ChatRequest) (string, error) {
+	// Define the URL and payload
+	url := p.BaseURL + "/api/chat"
+	payload := chatRequest{Model: p.Model, Messages: request.Messages, Format: request.Format, Options: request.Options}
+
+	resp, err := post(ctx, p.Client, url, "", payload)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	// Ollama streams the reply as lines of JSON, process each as it arrives
+	var finalResponse string
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var response LLMResponse
+		err = json.Unmarshal(line, &response)
+		if err != nil {
+			return "", fmt.Errorf("error unmarshalling response JSON line: %v", err)
+		}
+		// Ollama reports errors in the middle of the stream this way.
+		if response.Error != "" {
+			return "", fmt.Errorf("error from %s: %s", url, response.Error)
+		}
+
+		finalResponse += response.Message.Content
+		if request.Stream != nil && !request.Stream(response.Message.Content) {
+			return finalResponse, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("error reading response body: %w", err)
+	}
+
+	return finalResponse, nil
+}
+
+// Embed returns the embedding of text using the named embedding model.
+func (p *OllamaProvider) Embed(ctx context.Context, model string, text string) ([]float64, error) {
+	url := p.BaseURL + "/api/embeddings"
+	payload := map[string]string{"model": model, "prompt": text}
+
+	responseBody, err := postJSON(ctx, p.Client, url, "", payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var response struct {
+		Embedding []float64 `json:"embedding"`
+		Error     string    `json:"error"`
+	}
+	err = json.Unmarshal(responseBody, &response)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling embedding JSON: %v", err)
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("error from %s: %s", url, response.Error)
+	}
+	if len(response.Embedding) == 0 {
+		return nil, fmt.Errorf("no embedding returned from %s", url)
+	}
+
+	return response.Embedding, nil
+}
+
+func (p *OpenAIProvider) Name() string {
+	return "openai"
+}
+
+func (p *OpenAIProvider) SupportsFormat() bool {
+	return false
+}
+
+func (p *OpenAIProvider) Chat(ctx context.Context, request ChatRequest) (string, error) {
+	url := p.BaseURL + "/v1/chat/completions"
+	payload := map[string]interface{}{"model": p.Model, "messages": request.Messages}
+	for name, value := range request.Options {
+		if field, ok := openAIOptions[name]; ok {
+			payload[field] = value
+		}
+	}
+
+	responseBody, err := postJSON(ctx, p.Client, url, p.APIKey, payload)
+	if err != nil {
+		return "", err
+	}
+
+	var response openAIResponse
+	err = json.Unmarshal(responseBody, &response)
+	if err != nil {
+		return "", fmt.Errorf("error unmarshalling response JSON: %v", err)
+	}
+	if response.Error != nil {
+		return "", fmt.Errorf("error from %s: %s", url, response.Error.Message)
+	}
+	if len(response.Choices) == 0 {
+		return "", fmt.Errorf("no choices returned from %s", url)
+	}
+
+	return response.Choices[0].Message.Content, nil
+}
+
+// postJSON marshals the payload, POSTs it to url and returns the raw response
+// body. A status other than 200 OK is returned as a StatusError.
+func postJSON(ctx context.Context, client *http.Client, url string, apiKey string, payload interface{}) ([]byte, error) {
+	resp, err := post(ctx, client, url, apiKey, payload)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Read the response body
+	responseBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %w", err)
+	}
+
+	return responseBody, nil
+}
+
+// post marshals the payload and POSTs it to url, returning the response for
+// the caller to read and close. A status other than 200 OK is returned as a
+// StatusError.
+func post(ctx context.Context, client *http.Client, url string, apiKey string, payload interface{}) (*http.Response, error) {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling payload: %v", err)
+	}
+	body := bytes.NewReader(payloadBytes)
+
+	// Make the POST request
+	req, err := http.NewRequestWithContext(ctx, "POST", url, body)
+	if err != nil {
+		return nil, fmt.Errorf("error creating POST request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+
+	// Perform the request
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error performing POST request: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		responseBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		return nil, &StatusError{URL: url, StatusCode: resp.StatusCode, Message: errorMessage(responseBody)}
+	}
+
+	return resp, nil
+}
+
+// errorMessage digs the error out of a failed response, which is
+// {"error": "..."} from Ollama and {"error": {"message": "..."}} from OpenAI
+// compatible servers, or else returns the start of the body.
+func errorMessage(body []byte) string {
+	var response struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(body, &response); err == nil && len(response.Error) > 0 {
+		var message string
+		if err := json.Unmarshal(response.Error, &message); err == nil {
+			return message
+		}
+		var detail struct {
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal(response.Error, &detail); err == nil && detail.Message != "" {
+			return detail.Message
+		}
+	}
+
+	message := strings.TrimSpace(string(body))
+	if len(message) > 200 {
+		message = message[:200] + "..."
+	}
+	return message
+}
@@ -0,0 +1,233 @@
+package robocni
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestErrorMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "Ollama error",
+			body: `{"error": "model 'llama9' not found"}`,
+			want: "model 'llama9' not found",
+		},
+		{
+			name: "OpenAI error",
+			body: `{"error": {"message": "Incorrect API key provided", "type": "invalid_request_error"}}`,
+			want: "Incorrect API key provided",
+		},
+		{
+			name: "not JSON",
+			body: "  Bad Gateway\n",
+			want: "Bad Gateway",
+		},
+		{
+			name: "long body is cut",
+			body: strings.Repeat("x", 300),
+			want: strings.Repeat("x", 200) + "...",
+		},
+		{
+			name: "empty body",
+			body: "",
+			want: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorMessage([]byte(tt.body)); got != tt.want {
+				t.Errorf("errorMessage() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "overloaded",
+			err:  &StatusError{StatusCode: http.StatusTooManyRequests},
+			want: true,
+		},
+		{
+			name: "restarting",
+			err:  fmt.Errorf("error querying: %w", &StatusError{StatusCode: http.StatusServiceUnavailable}),
+			want: true,
+		},
+		{
+			name: "model not found",
+			err:  &StatusError{StatusCode: http.StatusNotFound, Message: "model not found"},
+			want: false,
+		},
+		{
+			name: "connection refused",
+			err:  fmt.Errorf("error performing POST request: %w", &net.OpError{Op: "dial", Err: errors.New("connection refused")}),
+			want: true,
+		},
+		{
+			name: "bad reply",
+			err:  errors.New("error unmarshalling response JSON line"),
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := transient(tt.err); got != tt.want {
+				t.Errorf("transient(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryLLM(t *testing.T) {
+	backoff := retryBackoff
+	retryBackoff = 0
+	defer func() { retryBackoff = backoff }()
+
+	tests := []struct {
+		name    string
+		retries int
+		// statuses are the replies to the queries in turn, after them the
+		// service answers.
+		statuses    []int
+		wantQueries int
+		// wantStatus is the status of the StatusError, 0 when the query works.
+		wantStatus int
+	}{
+		{
+			name:        "answer",
+			retries:     3,
+			wantQueries: 1,
+		},
+		{
+			name:        "retried until the service is back",
+			retries:     3,
+			statuses:    []int{http.StatusServiceUnavailable, http.StatusBadGateway},
+			wantQueries: 3,
+		},
+		{
+			name:        "out of retries",
+			retries:     1,
+			statuses:    []int{http.StatusTooManyRequests, http.StatusTooManyRequests},
+			wantQueries: 2,
+			wantStatus:  http.StatusTooManyRequests,
+		},
+		{
+			name:        "no retries",
+			statuses:    []int{http.StatusServiceUnavailable},
+			wantQueries: 1,
+			wantStatus:  http.StatusServiceUnavailable,
+		},
+		{
+			name:        "errors that aren't transient aren't retried",
+			retries:     3,
+			statuses:    []int{http.StatusNotFound},
+			wantQueries: 1,
+			wantStatus:  http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queries := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				queries++
+				if queries <= len(tt.statuses) {
+					w.WriteHeader(tt.statuses[queries-1])
+					fmt.Fprint(w, `{"error": "try again later"}`)
+					return
+				}
+				fmt.Fprintln(w, `{"message": {"role": "assistant", "content": " {\"name\": "}, "done": false}`)
+				fmt.Fprintln(w, `{"message": {"role": "assistant", "content": "\"mv\"} "}, "done": true}`)
+			}))
+			defer server.Close()
+
+			provider, err := NewProvider("ollama", server.URL, "", "", "test", "", nil)
+			if err != nil {
+				t.Fatalf("NewProvider() error: %v", err)
+			}
+			generator, err := NewGenerator(Options{Provider: provider, Retries: tt.retries})
+			if err != nil {
+				t.Fatalf("NewGenerator() error: %v", err)
+			}
+
+			response, err := generator.queryLLM(context.Background(), ChatRequest{}, 0)
+			if queries != tt.wantQueries {
+				t.Errorf("queryLLM() made %d queries, want %d", queries, tt.wantQueries)
+			}
+			if tt.wantStatus == 0 {
+				if err != nil {
+					t.Fatalf("queryLLM() error: %v", err)
+				}
+				if response != `{"name": "mv"}` {
+					t.Errorf("queryLLM() = %q, want the trimmed content", response)
+				}
+				return
+			}
+
+			var queryErr *QueryError
+			var statusErr *StatusError
+			if !errors.As(err, &queryErr) || !errors.As(err, &statusErr) {
+				t.Fatalf("queryLLM() error = %v, want a QueryError wrapping a StatusError", err)
+			}
+			if statusErr.StatusCode != tt.wantStatus || statusErr.Message != "try again later" {
+				t.Errorf("queryLLM() status = %d %q, want %d with the service's message", statusErr.StatusCode, statusErr.Message, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestQueryLLMStream(t *testing.T) {
+	tokens := []string{` {"name": `, `"mv", "ipam": {}`, `}`, "\n\nThis config ", "creates a macvlan."}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, token := range tokens {
+			line, _ := json.Marshal(LLMResponse{Message: ChatMessage{Role: "assistant", Content: token}})
+			fmt.Fprintln(w, string(line))
+		}
+	}))
+	defer server.Close()
+
+	provider, err := NewProvider("ollama", server.URL, "", "", "test", "", nil)
+	if err != nil {
+		t.Fatalf("NewProvider() error: %v", err)
+	}
+	var streamed []string
+	generator, err := NewGenerator(Options{Provider: provider, Stream: func(candidate int, token string) {
+		if candidate != 2 {
+			t.Errorf("Stream() got candidate %d, want 2", candidate)
+		}
+		streamed = append(streamed, token)
+	}})
+	if err != nil {
+		t.Fatalf("NewGenerator() error: %v", err)
+	}
+
+	response, err := generator.queryLLM(context.Background(), ChatRequest{}, 2)
+	if err != nil {
+		t.Fatalf("queryLLM() error: %v", err)
+	}
+	if response != `{"name": "mv", "ipam": {}}` {
+		t.Errorf("queryLLM() = %q, want the reply up to the end of the object", response)
+	}
+	if !reflect.DeepEqual(streamed, tokens[:3]) {
+		t.Errorf("Stream() got %q, want %q", streamed, tokens[:3])
+	}
+}
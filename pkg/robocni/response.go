@@ -0,0 +1,282 @@
+package robocni
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Reasons an attempt failed, as returned by FailureReason.
+const (
+	ReasonQuery         = "query"
+	ReasonNoJSON        = "no JSON"
+	ReasonInvalidJSON   = "invalid JSON"
+	ReasonMissingName   = "missing name"
+	ReasonInvalidConfig = "invalid config"
+	ReasonOther         = "other"
+)
+
+// QueryError is returned when the provider couldn't be queried, as opposed to
+// the model giving an answer that couldn't be used.
+type QueryError struct {
+	Provider string
+	Err      error
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("error querying %s provider: %v", e.Provider, e.Err)
+}
+
+func (e *QueryError) Unwrap() error {
+	return e.Err
+}
+
+// ResponseError is an answer from the model that isn't a CNI configuration,
+// Reason says why.
+type ResponseError struct {
+	Reason string
+	Err    error
+}
+
+func (e *ResponseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ResponseError) Unwrap() error {
+	return e.Err
+}
+
+// FailureReason tells why an attempt, or a whole generation, failed: one of
+// the Reason constants, or "" when err is nil.
+func FailureReason(err error) string {
+	var queryErr *QueryError
+	var responseErr *ResponseError
+	var validationErrs ValidationErrors
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &queryErr):
+		return ReasonQuery
+	case errors.As(err, &responseErr):
+		return responseErr.Reason
+	case errors.As(err, &validationErrs):
+		return ReasonInvalidConfig
+	}
+	return ReasonOther
+}
+
+// parseAndValidateJSON extracts the CNI configuration from the response and
+// validates it, returning the JSON, its name and any corrections made to it.
+func parseAndValidateJSON(response string, v Validator) (string, string, []string, error) {
+	jsonStr, err := extractJSON(response)
+	if err != nil {
+		return "", "", nil, &ResponseError{Reason: ReasonNoJSON, Err: err}
+	}
+
+	// Unmarshal the JSON into a map
+	var dataMap map[string]interface{}
+	err = json.Unmarshal([]byte(jsonStr), &dataMap)
+	if err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			err = fmt.Errorf("invalid JSON: %v at offset %d", err, syntaxErr.Offset)
+		} else {
+			err = fmt.Errorf("invalid JSON: %v", err)
+		}
+		return "", "", nil, &ResponseError{Reason: ReasonInvalidJSON, Err: err}
+	}
+
+	// Extract the "name" field
+	name, ok := dataMap["name"].(string)
+	if !ok {
+		return "", "", nil, &ResponseError{Reason: ReasonMissingName, Err: errors.New("name field not found or not a string")}
+	}
+
+	// Make sure the master really exists on the host
+	jsonStr, corrections, errs := verifyMaster(jsonStr, dataMap, v)
+
+	// Check it against the plugin's schema
+	errs = append(errs, validateConfig(dataMap, v.Hint)...)
+	if len(errs) > 0 {
+		return "", "", nil, errs
+	}
+
+	return jsonStr, name, corrections, nil
+}
+
+// extractJSON returns the JSON in a response. Constrained output is bare JSON,
+// otherwise it is taken from the first backtick-enclosed block.
+func extractJSON(response string) (string, error) {
+	trimmed := strings.TrimSpace(response)
+	if strings.HasPrefix(trimmed, "{") {
+		return trimmed, nil
+	}
+
+	// Find the start of the code block, supporting both ``` and ```json
+	start := strings.Index(response, "```")
+	if start == -1 {
+		return "", errors.New("no valid backtick-enclosed text found")
+	}
+	start += 3
+	if strings.HasPrefix(response[start:], "json") {
+		start += 4
+	}
+
+	// Find the end of the first code block
+	end := strings.Index(response[start:], "```")
+	if end == -1 {
+		return "", errors.New("no closing backticks found")
+	}
+
+	return strings.TrimSpace(response[start : start+end]), nil
+}
+
+// retryBackoff is how long to wait before the first retry of a query, it
+// doubles with every retry.
+var retryBackoff = time.Second
+
+// queryLLM sends the conversation to the provider and returns the trimmed
+// response. Queries that fail to reach the provider, or find it overloaded,
+// are retried up to Retries times. candidate is passed on to the Stream option.
+func (g *Generator) queryLLM(ctx context.Context, request ChatRequest, candidate int) (string, error) {
+	provider := g.opts.Provider
+	backoff := retryBackoff
+	for retry := 0; ; retry++ {
+		if g.opts.Stream != nil {
+			request.Stream = g.streamReply(candidate)
+		}
+		response, err := provider.Chat(ctx, request)
+		if err == nil {
+			// A streamed response was already shown as it arrived.
+			if g.opts.Debug && g.opts.Stream == nil {
+				g.log(strings.TrimSpace(response))
+			}
+			return strings.TrimSpace(response), nil
+		}
+		if retry >= g.opts.Retries || !transient(err) || ctx.Err() != nil {
+			return "", &QueryError{Provider: provider.Name(), Err: err}
+		}
+
+		g.log(fmt.Sprintf("Querying %s failed, retrying in %s: %v", provider.Name(), backoff, err))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return "", &QueryError{Provider: provider.Name(), Err: ctx.Err()}
+		}
+		backoff *= 2
+	}
+}
+
+// streamReply passes each piece of a reply on to the Stream option, until the
+// reply holds the complete JSON that extractJSON would take from it.
+func (g *Generator) streamReply(candidate int) func(token string) bool {
+	var reply replyScanner
+	return func(token string) bool {
+		g.opts.Stream(candidate, token)
+		if !reply.add(token) {
+			return true
+		}
+		if g.opts.Debug {
+			g.log("Got a complete JSON block, stopping the reply")
+		}
+		return false
+	}
+}
+
+// replyScanner follows a reply as it streams in, to tell when it holds a
+// complete JSON object, when the reply starts with one, or else a complete
+// backtick-enclosed block.
+type replyScanner struct {
+	reply strings.Builder
+	// started is set once the first non-space character has arrived, and
+	// object when that was the start of a JSON object.
+	started bool
+	object  bool
+	// depth counts the objects and arrays the reply is in, outside strings.
+	depth    int
+	inString bool
+	escaped  bool
+}
+
+// add appends the piece of the reply and reports whether the reply is complete.
+func (s *replyScanner) add(token string) bool {
+	s.reply.WriteString(token)
+	for i := 0; i < len(token) && (s.object || !s.started); i++ {
+		c := token[i]
+		if !s.started {
+			if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+				continue
+			}
+			s.started, s.object = true, c == '{'
+			if !s.object {
+				break
+			}
+		}
+
+		switch {
+		case s.escaped:
+			s.escaped = false
+		case s.inString:
+			s.escaped = c == '\\'
+			s.inString = c != '"'
+		case c == '"':
+			s.inString = true
+		case c == '{' || c == '[':
+			s.depth++
+		case c == '}' || c == ']':
+			s.depth--
+			if s.depth == 0 {
+				return true
+			}
+		}
+	}
+	if s.object {
+		return false
+	}
+	// Only a piece with backticks can complete the block.
+	return strings.Contains(token, "`") && hasFencedBlock(s.reply.String())
+}
+
+// hasFencedBlock reports whether the text holds a backtick-enclosed block,
+// closing backticks included.
+func hasFencedBlock(text string) bool {
+	start := strings.Index(text, "```")
+	if start == -1 {
+		return false
+	}
+	return strings.Contains(text[start+3:], "```")
+}
+
+// transient reports whether a failed query may work when retried: the
+// provider couldn't be reached, or was overloaded or restarting.
+func transient(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
+
+// RulesError is returned when the rules couldn't build a valid config for
+// the hint. It unwraps to ValidationErrors when the config was rejected.
+type RulesError struct {
+	Err error
+}
+
+func (e *RulesError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RulesError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,54 @@
+package robocni
+
+import "testing"
+
+func TestReplyScanner(t *testing.T) {
+	tests := []struct {
+		name   string
+		tokens []string
+		// want is the index of the token completing the reply, -1 when none does.
+		want int
+	}{
+		{
+			name:   "object",
+			tokens: []string{"\n ", `{"name": "mv", `, `"ipam": {"ranges": [[{"subnet": "10.0.0.0/24"}]]}`, "}", "\nDone"},
+			want:   3,
+		},
+		{
+			name:   "braces and quotes in strings",
+			tokens: []string{`{"name": "a}b", "note": "say \"}\" `, `and \\`, `"`, ` }`},
+			want:   3,
+		},
+		{
+			name:   "object not finished",
+			tokens: []string{`{"name": "mv", "ipam": {`, `"type": "dhcp"}`},
+			want:   -1,
+		},
+		{
+			name:   "fenced block",
+			tokens: []string{"Here it is:\n``", "`json\n{\"name\": \"mv\"}\n", "``", "`\nIt works."},
+			want:   3,
+		},
+		{
+			name:   "object in prose isn't the reply",
+			tokens: []string{"Use ", `{"name": "mv"}`, " as the config."},
+			want:   -1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var scanner replyScanner
+			got := -1
+			for i, token := range tt.tokens {
+				if scanner.add(token) {
+					got = i
+					break
+				}
+			}
+			if got != tt.want {
+				t.Errorf("replyScanner completed at token %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
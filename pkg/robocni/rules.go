@@ -0,0 +1,318 @@
+package robocni
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// ruleKeys are the keys understood in key=value hints.
+var ruleKeys = []string{"type", "master", "ipam", "whereabouts", "host-local", "static", "range", "subnet", "exclude", "gateway", "mode", "mtu", "vlan", "vlanid", "name", "bridge", "device", "namespace"}
+
+// ruleWords are the filler words allowed in simple keyword hints.
+var ruleWords = []string{"a", "an", "the", "on", "with", "using", "use", "for", "and", "to", "in", "of", "via", "is", "as", "mastered", "master", "ipam", "range", "ranged", "subnet", "mode", "mtu", "vlan", "id", "exclude", "excluding", "cni", "config", "configuration", "plugin", "network", "interface", "namespace"}
+
+// ruleModes are the mode values of the plugins in the catalogue.
+var ruleModes = map[string][]string{
+	"macvlan": {"bridge", "private", "vepa", "passthru"},
+	"ipvlan":  {"l2", "l3", "l3s"},
+}
+
+var numberPattern = regexp.MustCompile(`^\d+$`)
+
+// isStructuredHint reports whether every word of the hint is understood by
+// the rule based generator, so the LLM isn't needed.
+func isStructuredHint(hint string) bool {
+	constraints := analyzeHint(hint)
+	if constraints.PluginType == "" || len(constraints.Chained) > 0 {
+		return false
+	}
+	// type= and ipam= can name anything, the rules only know the keyword types.
+	if !isKeywordType(pluginKeywords, constraints.PluginType) ||
+		(constraints.IPAMType != "" && !isKeywordType(ipamKeywords, constraints.IPAMType)) {
+		return false
+	}
+	// A CIDR that isn't clearly a range or an exclusion, like "to 10.1.0.0/16",
+	// might be a route, which only the LLM can work out.
+	ranges, excludes := hintCIDRStrings(hint)
+	if len(ranges)+len(excludes) != len(cidrPattern.FindAllString(hint, -1)) {
+		return false
+	}
+
+	for _, token := range hintTokens(hint) {
+		if kv := strings.SplitN(token, "=", 2); len(kv) == 2 {
+			if !contains(ruleKeys, kv[0]) {
+				return false
+			}
+			continue
+		}
+		switch {
+		case contains(ruleWords, token),
+			contains(ruleModes[constraints.PluginType], token),
+			numberPattern.MatchString(token),
+			cidrPattern.MatchString(token),
+			net.ParseIP(token) != nil,
+			token == constraints.Master || token == constraints.Namespace:
+			continue
+		}
+		if keywordType(token) != "" {
+			continue
+		}
+		return false
+	}
+
+	return true
+}
+
+// hintTokens splits a hint into lower case words, dropping punctuation.
+func hintTokens(hint string) []string {
+	return strings.FieldsFunc(strings.ToLower(hint), func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\n' || r == ','
+	})
+}
+
+// keywordType returns the plugin or IPAM type a single word names, if any.
+func keywordType(token string) string {
+	for _, keyword := range pluginKeywords {
+		if keyword.Pattern.MatchString(token) {
+			return keyword.Type
+		}
+	}
+	for _, keyword := range ipamKeywords {
+		if keyword.Pattern.MatchString(token) {
+			return keyword.Type
+		}
+	}
+	return ""
+}
+
+// isKeywordType reports whether t is the type of one of the keywords.
+func isKeywordType(keywords []struct {
+	Type    string
+	Pattern *regexp.Regexp
+}, t string) bool {
+	for _, keyword := range keywords {
+		if keyword.Type == t {
+			return true
+		}
+	}
+	return false
+}
+
+// hintValues returns the key=value pairs of a hint.
+func hintValues(hint string) map[string]string {
+	values := map[string]string{}
+	for _, token := range strings.Fields(hint) {
+		if kv := strings.SplitN(strings.TrimRight(token, ","), "=", 2); len(kv) == 2 {
+			values[strings.ToLower(kv[0])] = kv[1]
+		}
+	}
+	return values
+}
+
+// jsonField is a field of an orderedJSON object.
+type jsonField struct {
+	Key   string
+	Value interface{}
+}
+
+// orderedJSON is a JSON object that keeps its fields in the order they were
+// added, so generated configs read like the examples.
+type orderedJSON []jsonField
+
+func (o orderedJSON) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	for i, field := range o {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		key, err := json.Marshal(field.Key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(field.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteString(":")
+		buf.Write(value)
+	}
+	buf.WriteString("}")
+	return buf.Bytes(), nil
+}
+
+// defaultRange is used when the hint has no addressing, as the prompt tells the LLM.
+const defaultRange = "10.20.0.0/16"
+
+// buildFromRules builds the CNI configuration for a structured hint from
+// the plugin catalogue, without asking the LLM.
+func buildFromRules(hint HintConstraints) (string, error) {
+	plugin := hint.PluginType
+	if plugin == "" {
+		return "", errors.New("the hint doesn't name a plugin type")
+	}
+	values := hintValues(hint.Hint)
+	tokens := hintTokens(hint.Hint)
+
+	master := hint.Master
+	if master == "" {
+		master = hint.DefaultMaster
+	}
+
+	name := values["name"]
+	if name == "" {
+		name = plugin
+		if hint.IPAMType != "" && hint.IPAMType != ipamNone {
+			name += "-" + hint.IPAMType
+		}
+	}
+
+	conf := orderedJSON{
+		{"cniVersion", "0.3.1"},
+		{"name", name},
+		{"type", plugin},
+	}
+
+	switch plugin {
+	case "bridge":
+		bridge := values["bridge"]
+		if bridge == "" {
+			bridge = "cni-" + strings.TrimPrefix(name, "bridge-")
+			if len(bridge) > 15 {
+				// Interface names are limited to 15 characters.
+				bridge = "cni-br0"
+			}
+		}
+		conf = append(conf, jsonField{"bridge", bridge})
+		if len(hint.VLANs) > 0 {
+			conf = append(conf, jsonField{"vlan", hint.VLANs[0]})
+		}
+	case "macvlan", "ipvlan":
+		if master != "" {
+			conf = append(conf, jsonField{"master", master})
+		}
+		mode := values["mode"]
+		for _, token := range tokens {
+			if mode == "" && contains(ruleModes[plugin], token) {
+				mode = token
+			}
+		}
+		if mode == "" {
+			mode = ruleModes[plugin][0]
+		}
+		conf = append(conf, jsonField{"mode", mode})
+	case "vlan":
+		if master == "" {
+			return "", errors.New("the vlan plugin needs a master interface")
+		}
+		if len(hint.VLANs) == 0 {
+			return "", errors.New("the vlan plugin needs a VLAN ID")
+		}
+		conf = append(conf, jsonField{"master", master}, jsonField{"vlanId", hint.VLANs[0]})
+	case "host-device":
+		device := values["device"]
+		if device == "" {
+			device = hint.Master
+		}
+		if device == "" {
+			return "", errors.New("the host-device plugin needs a device")
+		}
+		conf = append(conf, jsonField{"device", device})
+	case "ptp":
+		conf = append(conf, jsonField{"ipMasq", true})
+	case "sriov":
+		// The VF's deviceID is filled in by the SR-IOV device plugin.
+		if len(hint.VLANs) > 0 {
+			conf = append(conf, jsonField{"vlan", hint.VLANs[0]})
+		}
+	default:
+		return "", fmt.Errorf("there are no rules for the %s plugin", plugin)
+	}
+
+	if hint.MTU != 0 {
+		conf = append(conf, jsonField{"mtu", hint.MTU})
+	}
+
+	ipam, err := buildIPAMFromRules(hint, values)
+	if err != nil {
+		return "", err
+	}
+	conf = append(conf, jsonField{"ipam", ipam})
+
+	out, err := json.MarshalIndent(conf, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("error marshalling CNI config: %v", err)
+	}
+	return string(out), nil
+}
+
+// buildIPAMFromRules builds the ipam section, keeping the CIDRs as the user wrote them.
+func buildIPAMFromRules(hint HintConstraints, values map[string]string) (orderedJSON, error) {
+	ranges, excludes := hintCIDRStrings(hint.Hint)
+
+	ipamType := hint.IPAMType
+	if ipamType == "" {
+		ipamType = "whereabouts"
+	}
+	if len(ranges) == 0 {
+		// Every pod would get the same made up address.
+		if ipamType == "static" {
+			return nil, errors.New("static IPAM needs an address in the hint")
+		}
+		ranges = []string{defaultRange}
+	}
+
+	switch ipamType {
+	case ipamNone:
+		return orderedJSON{}, nil
+	case "dhcp":
+		return orderedJSON{{"type", "dhcp"}}, nil
+	case "whereabouts":
+		ipam := orderedJSON{{"type", "whereabouts"}, {"range", ranges[0]}}
+		if len(excludes) > 0 {
+			ipam = append(ipam, jsonField{"exclude", excludes})
+		}
+		return ipam, nil
+	case "host-local":
+		_, subnet, err := net.ParseCIDR(ranges[0])
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid CIDR", ranges[0])
+		}
+		ipam := orderedJSON{{"type", "host-local"}, {"subnet", subnet.String()}}
+		if gateway := values["gateway"]; gateway != "" {
+			ipam = append(ipam, jsonField{"gateway", gateway})
+		}
+		return ipam, nil
+	case "static":
+		address := orderedJSON{{"address", ranges[0]}}
+		if gateway := values["gateway"]; gateway != "" {
+			address = append(address, jsonField{"gateway", gateway})
+		}
+		return orderedJSON{{"type", "static"}, {"addresses", []orderedJSON{address}}}, nil
+	}
+
+	return nil, fmt.Errorf("there are no rules for %s IPAM", ipamType)
+}
+
+// generatorModes are the values of the -generator flag.
+var generatorModes = []string{"auto", "rules", "llm"}
+
+// useRuleGenerator decides, from the -generator flag, whether to build the
+// config from rules instead of asking the LLM.
+func useRuleGenerator(mode string, hint string) (bool, error) {
+	switch mode {
+	case "auto":
+		return isStructuredHint(hint), nil
+	case "rules":
+		return true, nil
+	case "llm":
+		return false, nil
+	}
+	return false, fmt.Errorf("unknown generator %q, must be one of: %s", mode, strings.Join(generatorModes, ", "))
+}
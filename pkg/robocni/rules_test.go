@@ -0,0 +1,128 @@
+package robocni
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestIsStructuredHint(t *testing.T) {
+	tests := []struct {
+		hint string
+		want bool
+	}{
+		{"macvlan on eth0 with whereabouts 10.40.0.0/24", true},
+		{"type=bridge ipam=none", true},
+		{"type=ipvlan master=eth0 mode=l3 ipam=host-local subnet=10.10.0.0/16 gateway=10.10.0.1", true},
+		{"type=tap master=eth0", false},
+		{"type=bridge ipam=calico-ipam", false},
+		{"type=bridge foo=bar", false},
+		{"bridge with tuning", false},
+		{"a macvlan that works for my database pods", false},
+		{"type=macvlan master=eth0 10.30.0.0/24", false},
+		{"macvlan eth0 10.1.0.0/16", false},
+		{"macvlan to 10.1.0.0/16", false},
+		{"macvlan eth0 whereabouts 300.1.0.0/16", false},
+		{"type=macvlan master=eth0 whereabouts=10.30.0.0/24", true},
+		{"macvlan eth0 whereabouts 10.40.0.0/24 exclude 10.40.0.0/28", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.hint, func(t *testing.T) {
+			if got := isStructuredHint(tt.hint); got != tt.want {
+				t.Errorf("isStructuredHint(%q) = %v, want %v", tt.hint, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildFromRules(t *testing.T) {
+	tests := []struct {
+		hint     string
+		wantType string
+		wantIPAM map[string]interface{}
+	}{
+		{
+			hint:     "macvlan on eth0 with whereabouts 10.40.0.0/24",
+			wantType: "macvlan",
+			wantIPAM: map[string]interface{}{"type": "whereabouts", "range": "10.40.0.0/24"},
+		},
+		{
+			hint:     "macvlan on eth0 with whereabouts 10.40.0.0/24 and a route to 192.168.0.0/16",
+			wantType: "macvlan",
+			wantIPAM: map[string]interface{}{"type": "whereabouts", "range": "10.40.0.0/24"},
+		},
+		{
+			hint:     "ipvlan on eth0 with whereabouts excluding 10.0.0.0/28 from 10.0.0.0/24",
+			wantType: "ipvlan",
+			wantIPAM: map[string]interface{}{"type": "whereabouts", "range": "10.0.0.0/24", "exclude": []interface{}{"10.0.0.0/28"}},
+		},
+		{
+			hint:     "type=bridge ipam=none",
+			wantType: "bridge",
+			wantIPAM: map[string]interface{}{},
+		},
+		{
+			hint:     "type=macvlan master=eth0 ipam=dhcp",
+			wantType: "macvlan",
+			wantIPAM: map[string]interface{}{"type": "dhcp"},
+		},
+		{
+			hint:     "type=vlan master=eth0 vlan=100 bridge=br0",
+			wantType: "vlan",
+			wantIPAM: map[string]interface{}{"type": "whereabouts", "range": defaultRange},
+		},
+		{
+			hint:     "type=ipvlan master=eth0 ipam=host-local subnet=10.10.0.0/16 gateway=10.10.0.1",
+			wantType: "ipvlan",
+			wantIPAM: map[string]interface{}{"type": "host-local", "subnet": "10.10.0.0/16", "gateway": "10.10.0.1"},
+		},
+		{
+			hint:     "type=host-device device=eth1 static=10.10.0.5/24 gateway=10.10.0.1",
+			wantType: "host-device",
+			wantIPAM: map[string]interface{}{"type": "static", "addresses": []interface{}{map[string]interface{}{"address": "10.10.0.5/24", "gateway": "10.10.0.1"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.hint, func(t *testing.T) {
+			hint := analyzeHint(tt.hint)
+			out, err := buildFromRules(hint)
+			if err != nil {
+				t.Fatalf("buildFromRules(%q) error: %v", tt.hint, err)
+			}
+			var conf map[string]interface{}
+			if err := json.Unmarshal([]byte(out), &conf); err != nil {
+				t.Fatalf("buildFromRules(%q) returned invalid JSON: %v", tt.hint, err)
+			}
+			if conf["type"] != tt.wantType {
+				t.Errorf("buildFromRules(%q) type = %v, want %s", tt.hint, conf["type"], tt.wantType)
+			}
+			if !reflect.DeepEqual(conf["ipam"], tt.wantIPAM) {
+				t.Errorf("buildFromRules(%q) ipam = %v, want %v", tt.hint, conf["ipam"], tt.wantIPAM)
+			}
+			if errs := hint.check(conf); len(errs) > 0 {
+				t.Errorf("buildFromRules(%q) doesn't honour the hint: %v", tt.hint, errs)
+			}
+		})
+	}
+}
+
+func TestBuildFromRulesErrors(t *testing.T) {
+	tests := []string{
+		"type=vlan vlan=100",
+		"type=vlan master=eth0",
+		"type=host-device",
+		"type=tap master=eth0",
+		"type=bridge ipam=calico-ipam",
+		"type=macvlan master=eth0 ipam=static",
+	}
+
+	for _, hint := range tests {
+		t.Run(hint, func(t *testing.T) {
+			if out, err := buildFromRules(analyzeHint(hint)); err == nil {
+				t.Errorf("buildFromRules(%q) = %s, want an error", hint, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,454 @@
+package robocni
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ValidationError is a single problem found in a generated CNI configuration.
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e ValidationError) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return e.Field + ": " + e.Message
+}
+
+// ValidationErrors is every problem found in a generated CNI configuration.
+type ValidationErrors []ValidationError
+
+func (v ValidationErrors) Error() string {
+	var problems []string
+	for _, e := range v {
+		problems = append(problems, e.Error())
+	}
+	return "invalid CNI configuration: " + strings.Join(problems, "; ")
+}
+
+// prefixed returns the errors with prefix added to every field name.
+func (v ValidationErrors) prefixed(prefix string) ValidationErrors {
+	var errs ValidationErrors
+	for _, e := range v {
+		e.Field = strings.TrimSuffix(prefix+e.Field, ".")
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+func (v *ValidationErrors) add(field string, format string, args ...interface{}) {
+	*v = append(*v, ValidationError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+type fieldKind int
+
+const (
+	kindString fieldKind = iota
+	kindBool
+	kindInt
+	kindObject
+	kindList
+	kindMAC
+)
+
+func (k fieldKind) String() string {
+	switch k {
+	case kindString:
+		return "a string"
+	case kindBool:
+		return "a boolean"
+	case kindInt:
+		return "an integer"
+	case kindObject:
+		return "an object"
+	case kindList:
+		return "a list"
+	case kindMAC:
+		return "a MAC address"
+	}
+	return "unknown"
+}
+
+// fieldSpec describes one field of a plugin's configuration.
+type fieldSpec struct {
+	Kind     fieldKind
+	Required bool
+	// Enum, for string fields, is the list of allowed values.
+	Enum []string
+	// Min and Max, for integer fields, bound the allowed values.
+	Min, Max int
+}
+
+// pluginSchema describes the configuration a CNI plugin accepts.
+type pluginSchema struct {
+	Fields map[string]fieldSpec
+	// RequiresIPAM is set for plugins that fail at ADD time without an IPAM
+	// type, unless they are chained after another plugin.
+	RequiresIPAM bool
+	// Chaining says where the plugin may appear in a conflist.
+	Chaining chainMode
+	// OneOf lists fields of which at least one must be set.
+	OneOf []string
+}
+
+// chainMode says where a plugin may appear in a conflist.
+type chainMode int
+
+const (
+	// chainNever plugins create an interface, so must come first.
+	chainNever chainMode = iota
+	// chainOptional plugins may also come after another plugin.
+	chainOptional
+	// chainOnly plugins modify an existing interface, so must be chained
+	// after another plugin.
+	chainOnly
+)
+
+var (
+	mtuField  = fieldSpec{Kind: kindInt, Min: 0, Max: 65535}
+	vlanField = fieldSpec{Kind: kindInt, Min: 0, Max: 4094}
+)
+
+var cniVersionField = fieldSpec{Kind: kindString, Enum: []string{"0.1.0", "0.2.0", "0.3.0", "0.3.1", "0.4.0", "1.0.0", "1.1.0"}}
+
+// conflistFields are the top level fields of a conflist.
+var conflistFields = map[string]fieldSpec{
+	"cniVersion":   {Kind: kindString, Required: true, Enum: cniVersionField.Enum},
+	"name":         {Kind: kindString, Required: true},
+	"plugins":      {Kind: kindList, Required: true},
+	"disableCheck": {Kind: kindBool},
+}
+
+// commonFields are valid in every plugin configuration.
+var commonFields = map[string]fieldSpec{
+	"cniVersion":    cniVersionField,
+	"name":          {Kind: kindString},
+	"type":          {Kind: kindString, Required: true},
+	"ipam":          {Kind: kindObject},
+	"dns":           {Kind: kindObject},
+	"args":          {Kind: kindObject},
+	"capabilities":  {Kind: kindObject},
+	"runtimeConfig": {Kind: kindObject},
+}
+
+// pluginSchemas are the plugins robocni knows how to validate, keyed by type.
+var pluginSchemas = map[string]pluginSchema{
+	"bridge": {
+		Fields: map[string]fieldSpec{
+			"bridge":              {Kind: kindString},
+			"isGateway":           {Kind: kindBool},
+			"isDefaultGateway":    {Kind: kindBool},
+			"forceAddress":        {Kind: kindBool},
+			"ipMasq":              {Kind: kindBool},
+			"mtu":                 mtuField,
+			"hairpinMode":         {Kind: kindBool},
+			"promiscMode":         {Kind: kindBool},
+			"vlan":                vlanField,
+			"preserveDefaultVlan": {Kind: kindBool},
+			"vlanTrunk":           {Kind: kindList},
+			"enabledad":           {Kind: kindBool},
+			"macspoofchk":         {Kind: kindBool},
+		},
+	},
+	"macvlan": {
+		Fields: map[string]fieldSpec{
+			"master":          {Kind: kindString},
+			"mode":            {Kind: kindString, Enum: []string{"bridge", "private", "vepa", "passthru"}},
+			"mtu":             mtuField,
+			"mac":             {Kind: kindMAC},
+			"linkInContainer": {Kind: kindBool},
+		},
+	},
+	"ipvlan": {
+		Fields: map[string]fieldSpec{
+			"master":          {Kind: kindString},
+			"mode":            {Kind: kindString, Enum: []string{"l2", "l3", "l3s"}},
+			"mtu":             mtuField,
+			"linkInContainer": {Kind: kindBool},
+		},
+		RequiresIPAM: true,
+		Chaining:     chainOptional,
+	},
+	"host-device": {
+		Fields: map[string]fieldSpec{
+			"device":     {Kind: kindString},
+			"hwaddr":     {Kind: kindMAC},
+			"kernelpath": {Kind: kindString},
+			"pciBusID":   {Kind: kindString},
+		},
+		OneOf: []string{"device", "hwaddr", "kernelpath", "pciBusID"},
+	},
+	"ptp": {
+		Fields: map[string]fieldSpec{
+			"ipMasq": {Kind: kindBool},
+			"mtu":    mtuField,
+		},
+		RequiresIPAM: true,
+	},
+	"vlan": {
+		Fields: map[string]fieldSpec{
+			"master":          {Kind: kindString, Required: true},
+			"vlanId":          {Kind: kindInt, Required: true, Min: 0, Max: 4094},
+			"mtu":             mtuField,
+			"linkInContainer": {Kind: kindBool},
+		},
+		RequiresIPAM: true,
+	},
+	"sriov": {
+		Fields: map[string]fieldSpec{
+			"deviceID":    {Kind: kindString},
+			"vlan":        vlanField,
+			"vlanQoS":     {Kind: kindInt, Min: 0, Max: 7},
+			"mac":         {Kind: kindMAC},
+			"spoofchk":    {Kind: kindString, Enum: []string{"on", "off"}},
+			"trust":       {Kind: kindString, Enum: []string{"on", "off"}},
+			"link_state":  {Kind: kindString, Enum: []string{"auto", "enable", "disable"}},
+			"min_tx_rate": {Kind: kindInt, Min: 0, Max: math.MaxInt32},
+			"max_tx_rate": {Kind: kindInt, Min: 0, Max: math.MaxInt32},
+			"logLevel":    {Kind: kindString, Enum: []string{"panic", "error", "warning", "info", "debug"}},
+			"logFile":     {Kind: kindString},
+		},
+	},
+	"tuning": {
+		Fields: map[string]fieldSpec{
+			"sysctl":   {Kind: kindObject},
+			"mac":      {Kind: kindMAC},
+			"promisc":  {Kind: kindBool},
+			"allmulti": {Kind: kindBool},
+			"mtu":      mtuField,
+		},
+		Chaining: chainOnly,
+	},
+	"sbr": {
+		Fields: map[string]fieldSpec{
+			"table": {Kind: kindInt, Min: 0, Max: math.MaxInt32},
+		},
+		Chaining: chainOnly,
+	},
+	"bandwidth": {
+		Fields: map[string]fieldSpec{
+			"ingressRate":  {Kind: kindInt, Min: 0, Max: math.MaxInt32},
+			"ingressBurst": {Kind: kindInt, Min: 0, Max: math.MaxInt32},
+			"egressRate":   {Kind: kindInt, Min: 0, Max: math.MaxInt32},
+			"egressBurst":  {Kind: kindInt, Min: 0, Max: math.MaxInt32},
+		},
+		Chaining: chainOnly,
+	},
+	"portmap": {
+		Fields: map[string]fieldSpec{
+			"snat":                 {Kind: kindBool},
+			"masqAll":              {Kind: kindBool},
+			"markMasqBit":          {Kind: kindInt, Min: 0, Max: 31},
+			"externalSetMarkChain": {Kind: kindString},
+			"conditionsV4":         {Kind: kindList},
+			"conditionsV6":         {Kind: kindList},
+		},
+		Chaining: chainOnly,
+	},
+}
+
+// Validator holds what generated configurations are checked against.
+type Validator struct {
+	Hint HintConstraints
+	// Host is the host's network, when known, to check master interfaces against.
+	Host *HostNetwork
+	// FixMaster replaces unusable master interfaces instead of rejecting them.
+	FixMaster bool
+}
+
+// pluginsOf returns the plugin configurations of a conflist, or the single
+// plugin configuration, and the prefix of fields in the first plugin.
+func pluginsOf(conf map[string]interface{}) ([]map[string]interface{}, string) {
+	list, ok := conf["plugins"].([]interface{})
+	if !ok {
+		return []map[string]interface{}{conf}, ""
+	}
+	var plugins []map[string]interface{}
+	for _, item := range list {
+		if plugin, ok := item.(map[string]interface{}); ok {
+			plugins = append(plugins, plugin)
+		}
+	}
+	return plugins, "plugins[0]."
+}
+
+// dns1123Label matches the names Kubernetes accepts for a net-attach-def.
+var dns1123Label = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// ValidNamespace reports whether Kubernetes accepts name as a namespace.
+func ValidNamespace(name string) bool {
+	return len(name) <= 63 && dns1123Label.MatchString(name)
+}
+
+// validateConfig checks a CNI configuration, or each plugin of a conflist,
+// against the schema of its plugin type and the IPAM addressing it uses,
+// returning every problem that would make the plugin refuse it or that
+// doesn't match the hint.
+func validateConfig(conf map[string]interface{}, hint HintConstraints) ValidationErrors {
+	var errs ValidationErrors
+
+	// Not doing what was asked is the most important thing to fix.
+	errs = append(errs, hint.check(conf)...)
+
+	if name, ok := conf["name"].(string); !ok {
+		errs.add("name", "field is required and must be a string")
+	} else if len(name) > 63 || !dns1123Label.MatchString(name) {
+		errs.add("name", "%q is not a valid DNS-1123 name, use only lowercase letters, digits and dashes", name)
+	}
+
+	if _, ok := conf["plugins"]; !ok {
+		return append(errs, validatePlugin(conf, false, hint)...)
+	}
+
+	validateFields(conf, conflistFields, "", &errs)
+	plugins := listOfObjects(conf, "plugins", "", &errs)
+	if len(plugins) == 0 {
+		errs.add("plugins", "must contain at least one plugin")
+	}
+	for i, plugin := range plugins {
+		errs = append(errs, validatePlugin(plugin, i > 0, hint).prefixed(fmt.Sprintf("plugins[%d].", i))...)
+	}
+
+	return errs
+}
+
+// validatePlugin checks a single plugin configuration, which is chained when
+// it comes after the first plugin of a conflist.
+func validatePlugin(conf map[string]interface{}, chained bool, hint HintConstraints) ValidationErrors {
+	var errs ValidationErrors
+
+	validateFields(conf, commonFields, "", &errs)
+
+	ipam, _ := conf["ipam"].(map[string]interface{})
+	if !chained {
+		// The hint's addressing is for the interface the first plugin creates.
+		errs = append(errs, validateIPAM(ipam, hint)...)
+	}
+
+	plugin, _ := conf["type"].(string)
+	schema, known := pluginSchemas[plugin]
+	if !known {
+		// We can't say much about plugins we don't know.
+		return errs
+	}
+
+	validateFields(conf, schema.Fields, "", &errs)
+
+	switch {
+	case schema.Chaining == chainOnly && !chained:
+		errs.add("type", "%s only works chained after an interface plugin, use a conflist with a plugins list", plugin)
+	case schema.Chaining == chainNever && chained:
+		errs.add("type", "%s creates an interface and must be the first plugin in the conflist", plugin)
+	}
+
+	if len(schema.OneOf) > 0 {
+		found := false
+		for _, field := range schema.OneOf {
+			if _, ok := conf[field]; ok {
+				found = true
+			}
+		}
+		if !found {
+			errs.add("", "%s requires one of: %s", plugin, strings.Join(schema.OneOf, ", "))
+		}
+	}
+
+	if ipamType, _ := ipam["type"].(string); ipamType == "" {
+		if schema.RequiresIPAM && !chained {
+			errs.add("ipam.type", "%s requires an IPAM plugin", plugin)
+		} else if len(ipam) > 0 {
+			errs.add("ipam.type", "is required when ipam is not empty")
+		}
+	}
+
+	if plugin == "bridge" {
+		_, hasVlan := conf["vlan"]
+		_, hasTrunk := conf["vlanTrunk"]
+		if hasVlan && hasTrunk {
+			errs.add("vlanTrunk", "cannot be set together with vlan")
+		}
+	}
+
+	return errs
+}
+
+// validateFields checks the fields of conf that appear in specs, prefixing
+// field names in errors with prefix.
+func validateFields(conf map[string]interface{}, specs map[string]fieldSpec, prefix string, errs *ValidationErrors) {
+	// Sort the field names so errors are reported in a stable order.
+	var names []string
+	for name := range specs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		spec := specs[name]
+		value, ok := conf[name]
+		if !ok {
+			if spec.Required {
+				errs.add(prefix+name, "field is required")
+			}
+			continue
+		}
+		if msg := checkField(spec, value); msg != "" {
+			errs.add(prefix+name, "%s", msg)
+		}
+	}
+}
+
+// checkField returns what is wrong with value according to spec, if anything.
+func checkField(spec fieldSpec, value interface{}) string {
+	switch spec.Kind {
+	case kindString, kindMAC:
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Sprintf("must be %s", spec.Kind)
+		}
+		if spec.Kind == kindMAC {
+			if _, err := net.ParseMAC(s); err != nil {
+				return fmt.Sprintf("%q is not a valid MAC address", s)
+			}
+		}
+		if len(spec.Enum) > 0 && !contains(spec.Enum, s) {
+			return fmt.Sprintf("must be one of %s (got %q)", strings.Join(spec.Enum, ", "), s)
+		}
+	case kindBool:
+		if _, ok := value.(bool); !ok {
+			return fmt.Sprintf("must be %s", spec.Kind)
+		}
+	case kindInt:
+		f, ok := value.(float64)
+		if !ok || f != math.Trunc(f) {
+			return fmt.Sprintf("must be %s", spec.Kind)
+		}
+		if (spec.Min != 0 || spec.Max != 0) && (f < float64(spec.Min) || f > float64(spec.Max)) {
+			return fmt.Sprintf("must be between %d and %d (got %v)", spec.Min, spec.Max, f)
+		}
+	case kindObject:
+		if _, ok := value.(map[string]interface{}); !ok {
+			return fmt.Sprintf("must be %s", spec.Kind)
+		}
+	case kindList:
+		if _, ok := value.([]interface{}); !ok {
+			return fmt.Sprintf("must be %s", spec.Kind)
+		}
+	}
+	return ""
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package robocni
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		conf string
+		// want are the fields with errors, in order.
+		want []string
+	}{
+		{
+			name: "macvlan",
+			conf: `{"cniVersion": "0.3.1", "name": "macvlan-conf", "type": "macvlan", "master": "eth0", "mode": "bridge", "ipam": {"type": "dhcp"}}`,
+		},
+		{
+			name: "macvlan with an unknown mode",
+			conf: `{"cniVersion": "0.3.1", "name": "macvlan-conf", "type": "macvlan", "master": "eth0", "mode": "l2"}`,
+			want: []string{"mode"},
+		},
+		{
+			name: "ipvlan without IPAM",
+			conf: `{"cniVersion": "0.3.1", "name": "ipvlan-conf", "type": "ipvlan", "master": "eth0", "mode": "l3"}`,
+			want: []string{"ipam.type"},
+		},
+		{
+			name: "bridge with a string mtu and a vlan out of range",
+			conf: `{"cniVersion": "0.3.1", "name": "mybridge", "type": "bridge", "mtu": "1500", "vlan": 5000}`,
+			want: []string{"mtu", "vlan"},
+		},
+		{
+			name: "bridge with vlan and vlanTrunk",
+			conf: `{"cniVersion": "0.3.1", "name": "mybridge", "type": "bridge", "vlan": 100, "vlanTrunk": [{"id": 200}]}`,
+			want: []string{"vlanTrunk"},
+		},
+		{
+			name: "vlan without vlanId",
+			conf: `{"cniVersion": "0.3.1", "name": "vlan-conf", "type": "vlan", "master": "eth0", "ipam": {"type": "dhcp"}}`,
+			want: []string{"vlanId"},
+		},
+		{
+			name: "vlan with a fractional vlanId",
+			conf: `{"cniVersion": "0.3.1", "name": "vlan-conf", "type": "vlan", "master": "eth0", "vlanId": 10.5, "ipam": {"type": "dhcp"}}`,
+			want: []string{"vlanId"},
+		},
+		{
+			name: "host-device without a device",
+			conf: `{"cniVersion": "0.3.1", "name": "hostdev", "type": "host-device"}`,
+			want: []string{""},
+		},
+		{
+			name: "host-device with an invalid hwaddr",
+			conf: `{"cniVersion": "0.3.1", "name": "hostdev", "type": "host-device", "hwaddr": "not-a-mac"}`,
+			want: []string{"hwaddr"},
+		},
+		{
+			name: "ipam without a type",
+			conf: `{"cniVersion": "0.3.1", "name": "mybridge", "type": "bridge", "ipam": {"subnet": "10.10.0.0/16"}}`,
+			want: []string{"ipam.type"},
+		},
+		{
+			name: "unknown cniVersion, missing name and invalid ipMasq",
+			conf: `{"cniVersion": "2.0", "type": "ptp", "ipMasq": "yes", "ipam": {"type": "dhcp"}}`,
+			want: []string{"name", "cniVersion", "ipMasq"},
+		},
+		{
+			name: "name that isn't DNS-1123",
+			conf: `{"cniVersion": "0.3.1", "name": "My_Net", "type": "bridge"}`,
+			want: []string{"name"},
+		},
+		{
+			name: "sbr on its own",
+			conf: `{"cniVersion": "0.3.1", "name": "sbr-conf", "type": "sbr", "table": -1}`,
+			want: []string{"table", "type"},
+		},
+		{
+			name: "conflist",
+			conf: `{"cniVersion": "0.4.0", "name": "tuned", "plugins": [{"type": "macvlan", "master": "eth0", "ipam": {"type": "dhcp"}}, {"type": "tuning", "sysctl": {"net.ipv4.ip_forward": "1"}}, {"type": "bandwidth", "ingressRate": 1000}]}`,
+		},
+		{
+			name: "conflist with a chained plugin first",
+			conf: `{"cniVersion": "0.4.0", "name": "tuned", "plugins": [{"type": "tuning"}, {"type": "macvlan", "master": "eth0", "ipam": {"type": "dhcp"}}]}`,
+			want: []string{"plugins[0].type", "plugins[1].type"},
+		},
+		{
+			name: "conflist without plugins",
+			conf: `{"cniVersion": "0.4.0", "name": "empty", "plugins": []}`,
+			want: []string{"plugins"},
+		},
+		{
+			name: "conflist with an invalid plugin",
+			conf: `{"cniVersion": "0.4.0", "name": "tuned", "plugins": [{"type": "macvlan", "mode": "l2", "ipam": {"type": "dhcp"}}, {"type": "bandwidth", "egressRate": "fast"}]}`,
+			want: []string{"plugins[0].mode", "plugins[1].egressRate"},
+		},
+		{
+			name: "unknown plugin",
+			conf: `{"cniVersion": "0.3.1", "name": "custom", "type": "my-plugin", "whatever": 1}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conf map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.conf), &conf); err != nil {
+				t.Fatalf("bad test config: %v", err)
+			}
+
+			var fields []string
+			for _, err := range validateConfig(conf, HintConstraints{}) {
+				fields = append(fields, err.Field)
+			}
+			if !reflect.DeepEqual(fields, tt.want) {
+				t.Errorf("validateConfig() errors on %v, want %v: %v", fields, tt.want, validateConfig(conf, HintConstraints{}))
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package robocni
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Candidate is one of several configs generated independently for the same
+// hint, to vote on.
+type Candidate struct {
+	Config   string
+	Name     string
+	Attempts []Attempt
+	Err      error
+}
+
+// voteConfig generates the Candidates configs, up to Parallel of them at a
+// time, and returns the config that most candidates agree on, along with
+// the share of candidates that agree with it as a confidence score.
+// Candidates are compared as canonical JSON, so field order and formatting
+// don't matter.
+func (g *Generator) voteConfig(ctx context.Context, request ChatRequest, validator Validator) (string, string, float64, []Candidate, error) {
+	n, parallel := g.opts.Candidates, g.opts.Parallel
+	candidates := make([]Candidate, n)
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, parallel)
+	for i := range candidates {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			candidate := &candidates[i]
+			candidate.Config, candidate.Name, candidate.Attempts, candidate.Err = g.generateConfig(ctx, candidateRequest(request, i), validator, i+1)
+		}(i)
+	}
+	wg.Wait()
+
+	votes := map[string]int{}
+	canonicals := make([]string, n)
+	for i, candidate := range candidates {
+		if candidate.Err != nil {
+			continue
+		}
+		canonical, err := canonicalJSON(candidate.Config)
+		if err != nil {
+			candidates[i].Err = err
+			continue
+		}
+		canonicals[i] = canonical
+		votes[canonical]++
+	}
+
+	// The earliest candidate wins a tie.
+	winner, winnerCanonical := -1, ""
+	for i, canonical := range canonicals {
+		if candidates[i].Err == nil && (winner == -1 || votes[canonical] > votes[winnerCanonical]) {
+			winner, winnerCanonical = i, canonical
+		}
+	}
+	if winner == -1 {
+		var attempts []Attempt
+		for _, candidate := range candidates {
+			attempts = append(attempts, candidate.Attempts...)
+		}
+		return "", "", 0, candidates, &GenerationError{Attempts: attempts, Candidates: n}
+	}
+
+	agreed := votes[winnerCanonical]
+	confidence := float64(agreed) / float64(n)
+	g.log(fmt.Sprintf("Picked the config agreed on by %d of %d candidates, confidence %.2f", agreed, n, confidence))
+	return candidates[winner].Config, candidates[winner].Name, confidence, candidates, nil
+}
+
+// candidateRequest gives each candidate its own seed, when one is set, as the
+// candidates would all be the same otherwise.
+func candidateRequest(request ChatRequest, i int) ChatRequest {
+	seed, ok := request.Options["seed"]
+	if !ok || i == 0 {
+		return request
+	}
+
+	options := map[string]interface{}{}
+	for name, value := range request.Options {
+		options[name] = value
+	}
+	switch seed := seed.(type) {
+	case int:
+		options["seed"] = seed + i
+	case int64:
+		options["seed"] = seed + int64(i)
+	case float64:
+		options["seed"] = seed + float64(i)
+	}
+	request.Options = options
+	return request
+}
+
+// canonicalJSON re-marshals the JSON with sorted keys and no whitespace.
+func canonicalJSON(str string) (string, error) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(str), &v); err != nil {
+		return "", fmt.Errorf("error parsing candidate JSON: %v", err)
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("error marshalling candidate JSON: %v", err)
+	}
+	return string(out), nil
+}
@@ -0,0 +1,147 @@
+package robocni
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// seedProvider replies with the config for the seed of the request, or
+// fails when there is none.
+type seedProvider map[int]string
+
+func (p seedProvider) Name() string         { return "seeds" }
+func (p seedProvider) SupportsFormat() bool { return true }
+
+func (p seedProvider) Chat(ctx context.Context, request ChatRequest) (string, error) {
+	if reply, ok := p[request.Options["seed"].(int)]; ok {
+		return reply, nil
+	}
+	return "", errors.New("no reply for this seed")
+}
+
+const (
+	bridgeMode = `{"cniVersion": "0.3.1", "name": "mv", "type": "macvlan", "master": "eth0", "mode": "bridge", "ipam": {"type": "dhcp"}}`
+	// bridgeModeReordered is bridgeMode with its fields in another order.
+	bridgeModeReordered = `{"name": "mv", "cniVersion": "0.3.1", "type": "macvlan", "mode": "bridge", "master": "eth0", "ipam": {"type": "dhcp"}}`
+	vepaMode            = `{"cniVersion": "0.3.1", "name": "mv", "type": "macvlan", "master": "eth0", "mode": "vepa", "ipam": {"type": "dhcp"}}`
+)
+
+func TestVoteConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider seedProvider
+		want     string
+		// wantConfidence is the share of the 4 candidates that agree.
+		wantConfidence float64
+		wantErr        bool
+	}{
+		{
+			name:           "majority",
+			provider:       seedProvider{1: vepaMode, 2: bridgeMode, 3: bridgeModeReordered, 4: bridgeMode + "\n"},
+			want:           bridgeMode,
+			wantConfidence: 0.75,
+		},
+		{
+			name:           "earliest candidate wins a tie",
+			provider:       seedProvider{1: vepaMode, 2: bridgeMode, 3: bridgeMode, 4: vepaMode},
+			want:           vepaMode,
+			wantConfidence: 0.5,
+		},
+		{
+			name:           "failed candidates don't vote",
+			provider:       seedProvider{2: bridgeMode, 4: vepaMode},
+			want:           bridgeMode,
+			wantConfidence: 0.25,
+		},
+		{
+			name:     "all candidates failed",
+			provider: seedProvider{},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := ChatRequest{Options: map[string]interface{}{"seed": 1}}
+			generator, err := NewGenerator(Options{Provider: tt.provider, MaxAttempts: 1, Candidates: 4, Parallel: 2})
+			if err != nil {
+				t.Fatalf("NewGenerator() error: %v", err)
+			}
+			config, _, confidence, candidates, err := generator.voteConfig(context.Background(), request, Validator{})
+			if len(candidates) != 4 {
+				t.Errorf("voteConfig() returned %d candidates, want 4", len(candidates))
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("voteConfig() = %s, want an error", config)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("voteConfig() error: %v", err)
+			}
+			if config != tt.want || confidence != tt.wantConfidence {
+				t.Errorf("voteConfig() = %s with confidence %.2f, want %s with %.2f", config, confidence, tt.want, tt.wantConfidence)
+			}
+		})
+	}
+}
+
+func TestCandidateRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]interface{}
+		i       int
+		want    map[string]interface{}
+	}{
+		{
+			name:    "first candidate keeps the seed",
+			options: map[string]interface{}{"seed": 42},
+			want:    map[string]interface{}{"seed": 42},
+		},
+		{
+			name:    "int seed",
+			options: map[string]interface{}{"seed": 42, "temperature": 0.5},
+			i:       2,
+			want:    map[string]interface{}{"seed": 44, "temperature": 0.5},
+		},
+		{
+			name:    "int64 seed",
+			options: map[string]interface{}{"seed": int64(42)},
+			i:       1,
+			want:    map[string]interface{}{"seed": int64(43)},
+		},
+		{
+			// Seeds read from JSON options are float64.
+			name:    "float64 seed",
+			options: map[string]interface{}{"seed": float64(42)},
+			i:       3,
+			want:    map[string]interface{}{"seed": float64(45)},
+		},
+		{
+			name:    "no seed",
+			options: map[string]interface{}{"temperature": 0.5},
+			i:       1,
+			want:    map[string]interface{}{"temperature": 0.5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := map[string]interface{}{}
+			for name, value := range tt.options {
+				original[name] = value
+			}
+
+			got := candidateRequest(ChatRequest{Options: tt.options}, tt.i)
+			if !reflect.DeepEqual(got.Options, tt.want) {
+				t.Errorf("candidateRequest() options = %v, want %v", got.Options, tt.want)
+			}
+			if !reflect.DeepEqual(tt.options, original) {
+				t.Errorf("candidateRequest() changed the request's options to %v", tt.options)
+			}
+		})
+	}
+}